@@ -0,0 +1,225 @@
+/*
+	Matchmaker
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"bufio"
+	"os"
+	"strings"
+	"strconv"
+	"encoding/binary"
+	"math"
+	"flag"
+	"time"
+)
+
+/*
+	Binary player arrivals format (little endian):
+
+		magic         [4]byte   "MMPA"
+		version       uint32    1
+		sampleDays    uint32    days of samples folded into each second. the matchmaker divides arrivals per second by this
+		numSeconds    uint32    seconds covered by the index. 86400 for a folded day, days * 86400 for a dated dataset
+		offsets       [numSeconds+1]uint64    index of the first record for each second. the last entry is the record count
+		records       [count]{ latitude float32, longitude float32 }
+*/
+
+const ArrivalsMagic = "MMPA"
+const ArrivalsVersion = 1
+const ArrivalsHeaderBytes = 16
+const ArrivalsRecordBytes = 8
+
+const SecondsPerDay = 86400
+
+var inputFilename = flag.String("input", "data/players.csv", "players csv to convert")
+var outputFilename = flag.String("output", "data/players.bin", "binary player arrivals file to write")
+var sampleDays = flag.Int("days", 5, "days of samples folded into each HH:MM:SS second of the csv. ignored for dated csv rows, or when the csv has a #days header from the generate command")
+
+var headerDays int // from a #days header, 0 if there is none
+
+// parseTime returns seconds since midnight for HH:MM:SS rows, or seconds since midnight of the first day for "2006-01-02 15:04:05" rows
+func parseTime(value string, firstDay *time.Time) (int64, bool, bool) {
+	if t, err := time.Parse("2006-01-02 15:04:05", value); err == nil {
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		if firstDay.IsZero() || day.Before(*firstDay) {
+			*firstDay = day
+		}
+		return t.Unix(), true, true
+	}
+	time_values := strings.Split(value, ":")
+	if len(time_values) != 3 {
+		return 0, false, false
+	}
+	time_hours, err1 := strconv.Atoi(time_values[0])
+	time_minutes, err2 := strconv.Atoi(time_values[1])
+	time_seconds, err3 := strconv.Atoi(time_values[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, false, false
+	}
+	seconds := int64(time_seconds) + int64(time_minutes)*60 + int64(time_hours)*60*60
+	if seconds < 0 || seconds >= SecondsPerDay {
+		return 0, false, false
+	}
+	return seconds, false, true
+}
+
+// scan calls the visit function for each valid row of the players csv
+func scan(filename string, visit func(seconds int64, dated bool, latitude float64, longitude float64), firstDay *time.Time) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		values := strings.Split(scanner.Text(), ",")
+		if len(values) == 2 && values[0] == "#days" {
+			days, err := strconv.Atoi(values[1])
+			if err != nil || days <= 0 {
+				panic(fmt.Sprintf("invalid #days header in %s: %s. days must be at least 1", filename, values[1]))
+			}
+			headerDays = days
+			continue
+		}
+		if len(values) != 3 {
+			continue
+		}
+		seconds, dated, ok := parseTime(values[0], firstDay)
+		if !ok {
+			continue
+		}
+		latitude, err1 := strconv.ParseFloat(values[1], 64)
+		longitude, err2 := strconv.ParseFloat(values[2], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		visit(seconds, dated, latitude, longitude)
+	}
+
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+}
+
+func main() {
+
+	flag.Parse()
+
+	if *sampleDays <= 0 {
+		panic(fmt.Sprintf("-days must be at least 1, got %d", *sampleDays))
+	}
+
+	// first pass: find the time range and count arrivals per second
+
+	var firstDay time.Time
+
+	numFolded := 0
+	numDated := 0
+	lastSecond := int64(0)
+
+	scan(*inputFilename, func(seconds int64, dated bool, latitude float64, longitude float64) {
+		if dated {
+			numDated++
+			if seconds > lastSecond {
+				lastSecond = seconds
+			}
+		} else {
+			numFolded++
+		}
+	}, &firstDay)
+
+	if numFolded > 0 && numDated > 0 {
+		panic("players csv mixes HH:MM:SS and dated rows")
+	}
+
+	numSeconds := int64(SecondsPerDay)
+	days := *sampleDays
+	if headerDays > 0 {
+		days = headerDays
+	}
+	start := int64(0)
+	if numDated > 0 {
+		start = firstDay.Unix()
+		numSeconds = ((lastSecond-start)/SecondsPerDay + 1) * SecondsPerDay
+		days = 1
+	}
+
+	counts := make([]uint64, numSeconds)
+
+	scan(*inputFilename, func(seconds int64, dated bool, latitude float64, longitude float64) {
+		counts[seconds-start]++
+	}, &firstDay)
+
+	// second pass: write each record into its slot
+
+	offsets := make([]uint64, numSeconds+1)
+	for i := int64(0); i < numSeconds; i++ {
+		offsets[i+1] = offsets[i] + counts[i]
+	}
+
+	numRecords := offsets[numSeconds]
+
+	records := make([]byte, numRecords*ArrivalsRecordBytes)
+
+	next := make([]uint64, numSeconds)
+	copy(next, offsets[:numSeconds])
+
+	scan(*inputFilename, func(seconds int64, dated bool, latitude float64, longitude float64) {
+		index := next[seconds-start] * ArrivalsRecordBytes
+		binary.LittleEndian.PutUint32(records[index:], math.Float32bits(float32(latitude)))
+		binary.LittleEndian.PutUint32(records[index+4:], math.Float32bits(float32(longitude)))
+		next[seconds-start]++
+	}, &firstDay)
+
+	f, err := os.Create(*outputFilename)
+	if err != nil {
+		panic(err)
+	}
+
+	defer f.Close()
+
+	writer := bufio.NewWriter(f)
+
+	header := make([]byte, ArrivalsHeaderBytes)
+	copy(header[0:4], ArrivalsMagic)
+	binary.LittleEndian.PutUint32(header[4:], ArrivalsVersion)
+	binary.LittleEndian.PutUint32(header[8:], uint32(days))
+	binary.LittleEndian.PutUint32(header[12:], uint32(numSeconds))
+	writer.Write(header)
+
+	offsetData := make([]byte, 8)
+	for i := range offsets {
+		binary.LittleEndian.PutUint64(offsetData, offsets[i])
+		writer.Write(offsetData)
+	}
+
+	writer.Write(records)
+
+	if err := writer.Flush(); err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("wrote %d arrivals over %d days (%d sample days per second) to %s\n", numRecords, numSeconds/SecondsPerDay, days, *outputFilename)
+}
@@ -25,9 +25,11 @@ import (
 	"regexp"
 	"encoding/binary"
 	"math"
+	"flag"
+	"strings"
+	"path/filepath"
 	/*
 	"bufio"
-	"strings"
 	"strconv"
 	*/
 )
@@ -44,11 +46,96 @@ const MaxLatitude = +90
 const MinLongitude = -180
 const MaxLongitude = +180
 
-func main() {
+const HistogramBucketSize = 5
+const HistogramBuckets = 52 // the last bucket holds everything >= 255ms
+const HistogramBytes = LatencyMapSize * HistogramBuckets * 4
 
-	// convert args into set of sums and counts filenames
+const CellFlag_Estimated = 0 // no samples. the matchmaker estimates latency from distance
+const CellFlag_Measured = 1
+const CellFlag_Filled = 2 // no samples. latency was filled in from neighbouring cells by transform
+
+var outputFilename = flag.String("output", "output.bin", "latency map file to write")
+var timeBuckets = flag.Int("buckets", 0, "average time of day shards (<name>_bNN_sums.bin etc.) into this many maps, written as <output>_bNN.bin")
+var percentile = flag.Float64("percentile", 0, "write this percentile (eg. 50, 90, 99) from *_histogram.bin shards instead of the mean from *_sums.bin/*_counts.bin shards")
+
+func bucketPercentile(histogram []uint32, percent float64) float32 {
+	total := uint64(0)
+	for i := range histogram {
+		total += uint64(histogram[i])
+	}
+	if total == 0 {
+		return 0.0
+	}
+	target := percent / 100.0 * float64(total)
+	cumulative := 0.0
+	for i := range histogram {
+		count := float64(histogram[i])
+		if count == 0.0 {
+			continue
+		}
+		if cumulative+count >= target || i == len(histogram)-1 {
+			start := float64(i * HistogramBucketSize)
+			if i == len(histogram)-1 {
+				return float32(start)
+			}
+			return float32(start + (target-cumulative)/count*HistogramBucketSize)
+		}
+		cumulative += count
+	}
+	return float32((len(histogram) - 1) * HistogramBucketSize)
+}
+
+func averageHistograms(args []string) ([]float32, []float32) {
+
+	histogram_total := make([]uint32, LatencyMapSize*HistogramBuckets)
+
+	for i := range args {
+
+		found, err := regexp.MatchString("^.*_histogram.bin$", args[i])
+		if err != nil {
+			panic(err)
+		}
+		if !found {
+			continue
+		}
+
+		fmt.Printf("%s\n", args[i])
+
+		histogram_data, err := os.ReadFile(args[i])
+		if err != nil {
+			fmt.Printf("missing histogram file: %s\n", args[i])
+			continue
+		}
+		if len(histogram_data) != HistogramBytes {
+			panic(fmt.Sprintf("histogram file %s is invalid size (%d bytes)", args[i], len(histogram_data)))
+		}
 
-	args := os.Args[1:]
+		index := 0
+		for j := range histogram_total {
+			histogram_total[j] += binary.LittleEndian.Uint32(histogram_data[index : index+4])
+			index += 4
+		}
+	}
+
+	// convert the merged histograms into a latency map at the requested percentile
+
+	latencyMap := make([]float32, LatencyMapSize)
+	samples := make([]float32, LatencyMapSize)
+
+	for i := 0; i < LatencyMapSize; i++ {
+		histogram := histogram_total[i*HistogramBuckets:(i+1)*HistogramBuckets]
+		latencyMap[i] = bucketPercentile(histogram, *percentile)
+		for j := range histogram {
+			samples[i] += float32(histogram[j])
+		}
+	}
+
+	return latencyMap, samples
+}
+
+func averageSums(args []string) ([]float32, []float32) {
+
+	// convert args into set of sums and counts filenames
 
 	sums := make([]string, 0)
 	counts := make([]string, 0)
@@ -112,22 +199,86 @@ func main() {
 	// convert the sums and totals into a latency map (float32)
 
 	latencyMap := make([]float32, LatencyMapSize)
+	samples := make([]float32, LatencyMapSize)
 
 	for i := 0; i < LatencyMapSize; i++ {
 		if counts_total[i] > 0.0 {
 			latencyMap[i] = float32(sums_total[i]/counts_total[i])
+			samples[i] = float32(counts_total[i])
 		}
 	}
 
-	// write the latency map to output.bin
+	return latencyMap, samples
+}
 
-	data := make([]byte, LatencyMapBytes)
+func writeFloatArray(filename string, floatArray []float32) {
+	data := make([]byte, len(floatArray)*4)
 	index := 0
-	for i := 0; i < LatencyMapSize; i++ {
-		integerValue := math.Float32bits(latencyMap[i])
+	for i := range floatArray {
+		integerValue := math.Float32bits(floatArray[i])
 		binary.LittleEndian.PutUint32(data[index:index+4], integerValue)
 		index += 4
 	}
+	os.WriteFile(filename, data, 0666)
+}
+
+func average(args []string, outputFilename string) {
+
+	var latencyMap []float32
+	var samples []float32
+	if *percentile > 0 {
+		latencyMap, samples = averageHistograms(args)
+	} else {
+		latencyMap, samples = averageSums(args)
+	}
 
-	os.WriteFile("output.bin", data, 0666)
+	// every cell with a latency value is measured at this point. transform marks the cells it fills in
+
+	flags := make([]byte, LatencyMapSize)
+	for i := 0; i < LatencyMapSize; i++ {
+		if latencyMap[i] > 0.0 {
+			flags[i] = CellFlag_Measured
+		} else {
+			flags[i] = CellFlag_Estimated
+		}
+	}
+
+	// write the latency map to the output file, with sample counts and cell flags alongside it
+
+	basename := strings.TrimSuffix(outputFilename, ".bin")
+
+	writeFloatArray(outputFilename, latencyMap)
+	writeFloatArray(basename+"_samples.bin", samples)
+	os.WriteFile(basename+"_flags.bin", flags, 0666)
+}
+
+func main() {
+
+	flag.Parse()
+
+	args := flag.Args()
+
+	if *timeBuckets == 0 {
+		average(args, *outputFilename)
+		return
+	}
+
+	// time of day shards are named <name>_bNN_sums.bin etc. average each bucket into its own map
+
+	basename := strings.TrimSuffix(*outputFilename, ".bin")
+
+	for bucket := 0; bucket < *timeBuckets; bucket++ {
+		bucketTag := fmt.Sprintf("_b%02d_", bucket)
+		bucketArgs := make([]string, 0)
+		for i := range args {
+			if strings.Contains(filepath.Base(args[i]), bucketTag) {
+				bucketArgs = append(bucketArgs, args[i])
+			}
+		}
+		if len(bucketArgs) == 0 {
+			fmt.Printf("no shards for time bucket %d\n", bucket)
+			continue
+		}
+		average(bucketArgs, fmt.Sprintf("%s_b%02d.bin", basename, bucket))
+	}
 }
@@ -0,0 +1,368 @@
+/*
+	Matchmaker
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"bufio"
+	"os"
+	"strings"
+	"strconv"
+	"math"
+	"math/rand"
+	"flag"
+	"sort"
+	"time"
+)
+
+const SecondsPerDay = 86400
+const MinutesPerDay = 1440
+
+const MinLatitude = -90
+const MaxLatitude = +90
+const MinLongitude = -180
+const MaxLongitude = +180
+
+const CellJitter = 0.5 // degrees. arrivals are spread uniformly around each density point
+
+var outputFilename = flag.String("output", "players.csv", "players file to write, in the same format as data/players.csv")
+var densityFilename = flag.String("density", "", "population density csv of latitude,longitude,weight. defaults to a built-in set of metro areas")
+var regionsFilename = flag.String("regions", "", "diurnal curves csv of name,minLatitude,maxLatitude,minLongitude,maxLongitude followed by 24 local time hourly weights")
+var concurrentUsers = flag.Float64("ccu", 25000, "target average concurrent users")
+var sessionSeconds = flag.Float64("session", 1320, "average seconds a player stays in the game per arrival (match length plus between match time, times matches played)")
+var sampleDays = flag.Int("days", 5, "days worth of samples to write. the count is written as a #days header that the matchmaker and arrivals commands divide arrivals per second by")
+var seed = flag.Int64("seed", 0, "random seed. 0 uses the current time")
+
+// DefaultDiurnalCurve is the share of players online per local hour, relative to the daily average
+var DefaultDiurnalCurve = [24]float64{0.60, 0.40, 0.30, 0.20, 0.15, 0.15, 0.20, 0.30, 0.45, 0.55, 0.65, 0.70, 0.75, 0.80, 0.85, 0.90, 1.00, 1.15, 1.35, 1.60, 1.80, 1.80, 1.50, 1.00}
+
+type DensityPoint struct {
+	latitude  float64
+	longitude float64
+	weight    float64
+	curve     *[24]float64
+}
+
+type Region struct {
+	name         string
+	minLatitude  float64
+	maxLatitude  float64
+	minLongitude float64
+	maxLongitude float64
+	curve        [24]float64
+}
+
+// default density is a rough population weighting of major metro areas, in millions
+var defaultDensity = []DensityPoint{
+	{latitude: 40.71, longitude: -74.00, weight: 19.0},  // new york
+	{latitude: 34.05, longitude: -118.24, weight: 13.0}, // los angeles
+	{latitude: 41.88, longitude: -87.63, weight: 9.5},   // chicago
+	{latitude: 32.78, longitude: -96.80, weight: 7.6},   // dallas
+	{latitude: 29.76, longitude: -95.37, weight: 7.1},   // houston
+	{latitude: 38.90, longitude: -77.04, weight: 6.3},   // washington dc
+	{latitude: 25.76, longitude: -80.19, weight: 6.1},   // miami
+	{latitude: 33.75, longitude: -84.39, weight: 6.1},   // atlanta
+	{latitude: 33.45, longitude: -112.07, weight: 4.9},  // phoenix
+	{latitude: 37.77, longitude: -122.42, weight: 4.7},  // san francisco
+	{latitude: 47.61, longitude: -122.33, weight: 4.0},  // seattle
+	{latitude: 39.74, longitude: -104.99, weight: 2.9},  // denver
+	{latitude: 43.65, longitude: -79.38, weight: 6.2},   // toronto
+	{latitude: 45.50, longitude: -73.57, weight: 4.3},   // montreal
+	{latitude: 49.28, longitude: -123.12, weight: 2.6},  // vancouver
+	{latitude: 19.43, longitude: -99.13, weight: 21.8},  // mexico city
+	{latitude: -23.55, longitude: -46.63, weight: 22.0}, // sao paulo
+	{latitude: -22.91, longitude: -43.17, weight: 13.5}, // rio de janeiro
+	{latitude: -34.60, longitude: -58.38, weight: 15.4}, // buenos aires
+	{latitude: -33.45, longitude: -70.67, weight: 6.8},  // santiago
+	{latitude: 4.71, longitude: -74.07, weight: 11.3},   // bogota
+	{latitude: -12.05, longitude: -77.04, weight: 10.9}, // lima
+	{latitude: 51.51, longitude: -0.13, weight: 14.3},   // london
+	{latitude: 48.86, longitude: 2.35, weight: 11.1},    // paris
+	{latitude: 52.52, longitude: 13.40, weight: 6.1},    // berlin
+	{latitude: 50.11, longitude: 8.68, weight: 5.8},     // frankfurt
+	{latitude: 52.37, longitude: 4.90, weight: 2.5},     // amsterdam
+	{latitude: 40.42, longitude: -3.70, weight: 6.7},    // madrid
+	{latitude: 41.39, longitude: 2.17, weight: 5.6},     // barcelona
+	{latitude: 41.90, longitude: 12.50, weight: 4.3},    // rome
+	{latitude: 59.33, longitude: 18.07, weight: 2.4},    // stockholm
+	{latitude: 52.23, longitude: 21.01, weight: 3.1},    // warsaw
+	{latitude: 55.76, longitude: 37.62, weight: 12.6},   // moscow
+	{latitude: 41.01, longitude: 28.98, weight: 15.5},   // istanbul
+	{latitude: 25.20, longitude: 55.27, weight: 3.5},    // dubai
+	{latitude: 30.04, longitude: 31.24, weight: 21.3},   // cairo
+	{latitude: -26.20, longitude: 28.05, weight: 5.6},   // johannesburg
+	{latitude: 6.52, longitude: 3.38, weight: 15.4},     // lagos
+	{latitude: 19.08, longitude: 72.88, weight: 20.7},   // mumbai
+	{latitude: 28.61, longitude: 77.21, weight: 31.2},   // delhi
+	{latitude: 1.35, longitude: 103.82, weight: 5.7},    // singapore
+	{latitude: 13.76, longitude: 100.50, weight: 10.7},  // bangkok
+	{latitude: -6.21, longitude: 106.85, weight: 10.8},  // jakarta
+	{latitude: 14.60, longitude: 120.98, weight: 14.2},  // manila
+	{latitude: 22.32, longitude: 114.17, weight: 7.5},   // hong kong
+	{latitude: 31.23, longitude: 121.47, weight: 27.1},  // shanghai
+	{latitude: 39.90, longitude: 116.41, weight: 20.5},  // beijing
+	{latitude: 37.57, longitude: 126.98, weight: 9.9},   // seoul
+	{latitude: 35.68, longitude: 139.69, weight: 37.3},  // tokyo
+	{latitude: 34.69, longitude: 135.50, weight: 19.1},  // osaka
+	{latitude: -33.87, longitude: 151.21, weight: 5.3},  // sydney
+	{latitude: -37.81, longitude: 144.96, weight: 5.1},  // melbourne
+	{latitude: -36.85, longitude: 174.76, weight: 1.7},  // auckland
+}
+
+func normalizeCurve(curve *[24]float64) {
+	sum := 0.0
+	for i := range curve {
+		sum += curve[i]
+	}
+	if sum <= 0.0 {
+		panic("diurnal curve must have a positive weight")
+	}
+	for i := range curve {
+		curve[i] *= 24.0 / sum
+	}
+}
+
+// curveValue interpolates the hourly curve at a fractional local hour, so arrivals ramp smoothly instead of stepping each hour
+func curveValue(curve *[24]float64, localHour float64) float64 {
+	localHour = math.Mod(localHour, 24.0)
+	if localHour < 0.0 {
+		localHour += 24.0
+	}
+	hour := int(math.Floor(localHour))
+	next := (hour + 1) % 24
+	t := localHour - float64(hour)
+	return curve[hour]*(1.0-t) + curve[next]*t
+}
+
+func poisson(lambda float64) int {
+	if lambda <= 0.0 {
+		return 0
+	}
+	if lambda > 30.0 {
+		value := int(math.Round(rand.NormFloat64()*math.Sqrt(lambda) + lambda))
+		if value < 0 {
+			value = 0
+		}
+		return value
+	}
+	limit := math.Exp(-lambda)
+	product := rand.Float64()
+	count := 0
+	for product > limit {
+		product *= rand.Float64()
+		count++
+	}
+	return count
+}
+
+func loadDensity(filename string) []DensityPoint {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	density := make([]DensityPoint, 0)
+
+	for scanner.Scan() {
+		values := strings.Split(scanner.Text(), ",")
+		if len(values) != 3 {
+			continue
+		}
+		latitude, err1 := strconv.ParseFloat(values[0], 64)
+		longitude, err2 := strconv.ParseFloat(values[1], 64)
+		weight, err3 := strconv.ParseFloat(values[2], 64)
+		if err1 != nil || err2 != nil || err3 != nil || weight <= 0.0 {
+			continue
+		}
+		density = append(density, DensityPoint{latitude: latitude, longitude: longitude, weight: weight})
+	}
+
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	return density
+}
+
+func loadRegions(filename string) []Region {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	regions := make([]Region, 0)
+
+	for scanner.Scan() {
+		values := strings.Split(scanner.Text(), ",")
+		if len(values) != 5+24 {
+			continue
+		}
+		region := Region{name: values[0]}
+		var bounds [4]float64
+		valid := true
+		for i := range bounds {
+			value, err := strconv.ParseFloat(values[1+i], 64)
+			if err != nil {
+				valid = false
+			}
+			bounds[i] = value
+		}
+		for i := range region.curve {
+			value, err := strconv.ParseFloat(values[5+i], 64)
+			if err != nil {
+				valid = false
+			}
+			region.curve[i] = value
+		}
+		if !valid {
+			continue
+		}
+		region.minLatitude, region.maxLatitude, region.minLongitude, region.maxLongitude = bounds[0], bounds[1], bounds[2], bounds[3]
+		normalizeCurve(&region.curve)
+		regions = append(regions, region)
+	}
+
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	return regions
+}
+
+func main() {
+
+	flag.Parse()
+
+	if *sampleDays <= 0 {
+		panic(fmt.Sprintf("-days must be at least 1, got %d", *sampleDays))
+	}
+
+	if *seed == 0 {
+		rand.Seed(time.Now().UnixNano())
+	} else {
+		rand.Seed(*seed)
+	}
+
+	// load population density and assign each point the diurnal curve of the first region that contains it
+
+	density := defaultDensity
+	if *densityFilename != "" {
+		density = loadDensity(*densityFilename)
+	}
+
+	if len(density) == 0 {
+		panic("population density is empty")
+	}
+
+	regions := make([]Region, 0)
+	if *regionsFilename != "" {
+		regions = loadRegions(*regionsFilename)
+	}
+
+	defaultCurve := DefaultDiurnalCurve
+	normalizeCurve(&defaultCurve)
+
+	totalWeight := 0.0
+	for i := range density {
+		totalWeight += density[i].weight
+		density[i].curve = &defaultCurve
+		for j := range regions {
+			if density[i].latitude >= regions[j].minLatitude && density[i].latitude <= regions[j].maxLatitude && density[i].longitude >= regions[j].minLongitude && density[i].longitude <= regions[j].maxLongitude {
+				density[i].curve = &regions[j].curve
+				break
+			}
+		}
+	}
+
+	// little's law: concurrent users = arrival rate * time in game per arrival
+
+	arrivalsPerSecond := *concurrentUsers / *sessionSeconds
+
+	fmt.Printf("%d density points, %d regions\n", len(density), len(regions))
+	fmt.Printf("%.1f arrivals per second on average for %.0f concurrent users\n", arrivalsPerSecond, *concurrentUsers)
+
+	f, err := os.Create(*outputFilename)
+	if err != nil {
+		panic(err)
+	}
+
+	defer f.Close()
+
+	writer := bufio.NewWriter(f)
+
+	defer writer.Flush()
+
+	// diurnal curves are in local solar time, so the arrival mix shifts around the globe each minute
+
+	cumulative := make([]float64, len(density))
+
+	fmt.Fprintf(writer, "#days,%d\n", *sampleDays)
+
+	numArrivals := 0
+	peakArrivals := 0.0
+
+	for minute := 0; minute < MinutesPerDay; minute++ {
+
+		utcHour := float64(minute) / 60.0
+
+		sum := 0.0
+		for i := range density {
+			localHour := utcHour + density[i].longitude/15.0
+			sum += density[i].weight / totalWeight * curveValue(density[i].curve, localHour)
+			cumulative[i] = sum
+		}
+
+		lambda := arrivalsPerSecond * sum
+		if lambda > peakArrivals {
+			peakArrivals = lambda
+		}
+
+		for second := minute * 60; second < (minute+1)*60; second++ {
+
+			count := poisson(lambda * float64(*sampleDays))
+
+			for j := 0; j < count; j++ {
+				index := sort.SearchFloat64s(cumulative, rand.Float64()*sum)
+				if index >= len(density) {
+					index = len(density) - 1
+				}
+				latitude := density[index].latitude + (rand.Float64()*2.0-1.0)*CellJitter
+				longitude := density[index].longitude + (rand.Float64()*2.0-1.0)*CellJitter
+				latitude = math.Max(MinLatitude, math.Min(MaxLatitude, latitude))
+				longitude = math.Max(MinLongitude, math.Min(MaxLongitude, longitude))
+				fmt.Fprintf(writer, "%02d:%02d:%02d,%.4f,%.4f\n", second/3600, (second/60)%60, second%60, latitude, longitude)
+				numArrivals++
+			}
+		}
+	}
+
+	fmt.Printf("peak %.1f arrivals per second\n", peakArrivals)
+	fmt.Printf("wrote %d arrivals (%d days) to %s\n", numArrivals, *sampleDays, *outputFilename)
+}
@@ -0,0 +1,382 @@
+/*
+	Matchmaker
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"bufio"
+	"os"
+	"strings"
+	"strconv"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"flag"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const LatencyMapWidth = 360
+const LatencyMapHeight = 180
+const LatencyMapSize = LatencyMapWidth * LatencyMapHeight
+
+const MinLatitude = -90
+const MaxLatitude = +90
+const MinLongitude = -180
+const MaxLongitude = +180
+
+const HistogramBucketSize = 5
+const HistogramBuckets = 52 // the last bucket holds everything >= 255ms
+
+const MaxRTT = 1000.0 // samples above this are treated as timeouts, not latency
+
+const SecondsPerDay = 86400
+
+var outputDirectory = flag.String("output", ".", "directory to write *_sums.bin and *_counts.bin shards to")
+var writeHistograms = flag.Bool("histogram", false, "also write *_histogram.bin shards for percentile maps. each datacenter and time bucket that gets samples holds a 13MB histogram in memory, so 24 buckets for 100 datacenters can take over 30GB")
+var timeBuckets = flag.Int("buckets", 0, "split shards into this many time of day buckets (UTC), eg. 24 writes <city>_b00_sums.bin to <city>_b23_sums.bin")
+
+type Shard struct {
+	sums      []float64
+	counts    []float64
+	histogram []uint32
+}
+
+type Datacenter struct {
+	name      string
+	latitude  float64
+	longitude float64
+	shards    []*Shard // one per time of day bucket
+}
+
+type PingSample struct {
+	timestamp  string
+	latitude   float64
+	longitude  float64
+	datacenter string
+	rtt        float64
+}
+
+func numTimeBuckets() int {
+	if *timeBuckets > 0 {
+		return *timeBuckets
+	}
+	return 1
+}
+
+// parseSecondsOfDay accepts unix seconds, RFC3339, "2006-01-02 15:04:05" or "15:04:05" timestamps and returns seconds since midnight UTC.
+// unix timestamps before the epoch are rejected
+func parseSecondsOfDay(timestamp string) (int, bool) {
+	if unixSeconds, err := strconv.ParseFloat(timestamp, 64); err == nil {
+		if unixSeconds < 0.0 || unixSeconds > math.MaxInt64/2 {
+			return 0, false
+		}
+		return int(int64(math.Floor(unixSeconds)) % SecondsPerDay), true
+	}
+	layouts := []string{time.RFC3339, "2006-01-02 15:04:05", "15:04:05"}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, timestamp); err == nil {
+			t = t.UTC()
+			return t.Hour()*3600 + t.Minute()*60 + t.Second(), true
+		}
+	}
+	return 0, false
+}
+
+func haversineDistance(lat1 float64, long1 float64, lat2 float64, long2 float64) float64 {
+	lat1 *= math.Pi / 180
+	lat2 *= math.Pi / 180
+	long1 *= math.Pi / 180
+	long2 *= math.Pi / 180
+	delta_lat := lat2 - lat1
+	delta_long := long2 - long1
+	lat_sine := math.Sin(delta_lat / 2)
+	long_sine := math.Sin(delta_long / 2)
+	a := lat_sine*lat_sine + math.Cos(lat1)*math.Cos(lat2)*long_sine*long_sine
+	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+	r := 6371.0
+	d := r * c
+	return d // kilometers
+}
+
+func kilometersToRTT(kilometers float64) float64 {
+	return kilometers / 299792.458 * 1000.0 * 2.0 * (3.0 / 2.0) // speed of light is 2/3rds in fiber optic cables
+}
+
+func getLatencyMapIndex(latitude float64, longitude float64) int {
+	x := int(math.Floor(longitude)) - MinLongitude
+	y := MaxLatitude - int(math.Floor(latitude))
+	if x < 0 {
+		x = 0
+	} else if x >= LatencyMapWidth {
+		x = LatencyMapWidth - 1
+	}
+	if y < 0 {
+		y = 0
+	} else if y >= LatencyMapHeight {
+		y = LatencyMapHeight - 1
+	}
+	return x + y*LatencyMapWidth
+}
+
+func parseCSV(line string) (PingSample, bool) {
+	values := strings.Split(line, ",")
+	if len(values) != 5 {
+		return PingSample{}, false
+	}
+	latitude, err := strconv.ParseFloat(strings.TrimSpace(values[1]), 64)
+	if err != nil {
+		return PingSample{}, false
+	}
+	longitude, err := strconv.ParseFloat(strings.TrimSpace(values[2]), 64)
+	if err != nil {
+		return PingSample{}, false
+	}
+	rtt, err := strconv.ParseFloat(strings.TrimSpace(values[4]), 64)
+	if err != nil {
+		return PingSample{}, false
+	}
+	return PingSample{timestamp: strings.TrimSpace(values[0]), latitude: latitude, longitude: longitude, datacenter: strings.TrimSpace(values[3]), rtt: rtt}, true
+}
+
+func parseNDJSON(line string) (PingSample, bool) {
+	var values struct {
+		Timestamp  any     `json:"timestamp"`
+		Latitude   float64 `json:"latitude"`
+		Longitude  float64 `json:"longitude"`
+		Datacenter any     `json:"datacenter"`
+		RTT        float64 `json:"rtt"`
+	}
+	if err := json.Unmarshal([]byte(line), &values); err != nil {
+		return PingSample{}, false
+	}
+	timestamp := ""
+	switch v := values.Timestamp.(type) {
+	case string:
+		timestamp = v
+	case float64:
+		timestamp = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	datacenter := ""
+	switch v := values.Datacenter.(type) {
+	case string:
+		datacenter = v
+	case float64:
+		datacenter = strconv.FormatUint(uint64(v), 10)
+	default:
+		return PingSample{}, false
+	}
+	return PingSample{timestamp: timestamp, latitude: values.Latitude, longitude: values.Longitude, datacenter: datacenter, rtt: values.RTT}, true
+}
+
+func writeFloat64Array(filename string, array []float64) {
+	data := make([]byte, len(array)*8)
+	index := 0
+	for i := range array {
+		binary.LittleEndian.PutUint64(data[index:index+8], math.Float64bits(array[i]))
+		index += 8
+	}
+	os.WriteFile(filename, data, 0666)
+}
+
+func writeUint32Array(filename string, array []uint32) {
+	data := make([]byte, len(array)*4)
+	index := 0
+	for i := range array {
+		binary.LittleEndian.PutUint32(data[index:index+4], array[i])
+		index += 4
+	}
+	os.WriteFile(filename, data, 0666)
+}
+
+func main() {
+
+	flag.Parse()
+
+	if len(flag.Args()) == 0 {
+		fmt.Printf("usage: ingest [-output dir] [-histogram] [-buckets N] <pings.csv|pings.ndjson> ...\n")
+		os.Exit(1)
+	}
+
+	// load datacenters. ping samples can refer to a datacenter by id or by name
+
+	f, err := os.Open("data/datacenters.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	datacenters := make(map[string]*Datacenter)
+
+	for scanner.Scan() {
+		values := strings.Split(scanner.Text(), ",")
+		if len(values) != 4 {
+			continue
+		}
+		datacenterId := values[0]
+		city := values[1]
+		latitude, _ := strconv.ParseFloat(values[2], 64)
+		longitude, _ := strconv.ParseFloat(values[3], 64)
+		datacenter := &Datacenter{name: city, latitude: latitude, longitude: longitude, shards: make([]*Shard, numTimeBuckets())}
+		datacenters[datacenterId] = datacenter
+		datacenters[city] = datacenter
+	}
+
+	// bin ping samples into per-datacenter sums and counts
+
+	numAccepted := 0
+	numMalformed := 0
+	numUnknownDatacenter := 0
+	numOutOfRange := 0
+	numFasterThanLight := 0
+	numBadTimestamp := 0
+
+	for _, filename := range flag.Args() {
+
+		fmt.Printf("%s\n", filename)
+
+		input, err := os.Open(filename)
+		if err != nil {
+			fmt.Printf("missing ping file: %s\n", filename)
+			continue
+		}
+
+		parse := parseCSV
+		extension := filepath.Ext(filename)
+		if extension == ".ndjson" || extension == ".jsonl" || extension == ".json" {
+			parse = parseNDJSON
+		}
+
+		scanner := bufio.NewScanner(input)
+
+		for scanner.Scan() {
+
+			sample, ok := parse(scanner.Text())
+			if !ok {
+				numMalformed++
+				continue
+			}
+
+			datacenter := datacenters[sample.datacenter]
+			if datacenter == nil {
+				numUnknownDatacenter++
+				continue
+			}
+
+			if sample.latitude < MinLatitude || sample.latitude > MaxLatitude || sample.longitude < MinLongitude || sample.longitude > MaxLongitude || sample.rtt <= 0.0 || sample.rtt > MaxRTT {
+				numOutOfRange++
+				continue
+			}
+
+			// IMPORTANT: reject samples faster than light in fiber could travel to the datacenter and back. these are bad geolocation
+
+			kilometers := haversineDistance(sample.latitude, sample.longitude, datacenter.latitude, datacenter.longitude)
+			if sample.rtt < kilometersToRTT(kilometers) {
+				numFasterThanLight++
+				continue
+			}
+
+			timeBucket := 0
+			if *timeBuckets > 0 {
+				secondsOfDay, ok := parseSecondsOfDay(sample.timestamp)
+				if !ok || secondsOfDay < 0 || secondsOfDay >= SecondsPerDay {
+					numBadTimestamp++
+					continue
+				}
+				timeBucket = secondsOfDay * *timeBuckets / SecondsPerDay
+			}
+
+			shard := datacenter.shards[timeBucket]
+			if shard == nil {
+				shard = &Shard{}
+				shard.sums = make([]float64, LatencyMapSize)
+				shard.counts = make([]float64, LatencyMapSize)
+				if *writeHistograms {
+					shard.histogram = make([]uint32, LatencyMapSize*HistogramBuckets)
+				}
+				datacenter.shards[timeBucket] = shard
+			}
+
+			index := getLatencyMapIndex(sample.latitude, sample.longitude)
+
+			shard.sums[index] += sample.rtt
+			shard.counts[index]++
+
+			if shard.histogram != nil {
+				bucket := int(sample.rtt) / HistogramBucketSize
+				if bucket >= HistogramBuckets {
+					bucket = HistogramBuckets - 1
+				}
+				shard.histogram[index*HistogramBuckets+bucket]++
+			}
+
+			numAccepted++
+		}
+
+		if err := scanner.Err(); err != nil {
+			panic(err)
+		}
+
+		input.Close()
+	}
+
+	// write out shards for each datacenter and time bucket that received samples
+
+	names := make([]string, 0)
+	for key, datacenter := range datacenters {
+		if key == datacenter.name {
+			names = append(names, key)
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		datacenter := datacenters[name]
+		for timeBucket, shard := range datacenter.shards {
+			if shard == nil {
+				continue
+			}
+			basename := filepath.Join(*outputDirectory, name)
+			if *timeBuckets > 0 {
+				basename = fmt.Sprintf("%s_b%02d", basename, timeBucket)
+			}
+			writeFloat64Array(basename+"_sums.bin", shard.sums)
+			writeFloat64Array(basename+"_counts.bin", shard.counts)
+			if shard.histogram != nil {
+				writeUint32Array(basename+"_histogram.bin", shard.histogram)
+			}
+			fmt.Printf("wrote %s\n", basename)
+		}
+	}
+
+	fmt.Printf("\n%d accepted\n", numAccepted)
+	fmt.Printf("%d malformed\n", numMalformed)
+	fmt.Printf("%d unknown datacenter\n", numUnknownDatacenter)
+	fmt.Printf("%d out of range\n", numOutOfRange)
+	fmt.Printf("%d faster than light\n", numFasterThanLight)
+	if *timeBuckets > 0 {
+		fmt.Printf("%d bad timestamp\n", numBadTimestamp)
+	}
+}
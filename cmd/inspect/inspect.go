@@ -0,0 +1,312 @@
+/*
+	Matchmaker
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"image/color"
+	"math"
+)
+
+const LatencyMapWidth = 360
+const LatencyMapHeight = 180
+const LatencyMapSize = LatencyMapWidth * LatencyMapHeight
+const LatencyMapBytes = LatencyMapSize * 4
+
+const MaxLatitude = +90
+const MinLongitude = -180
+
+const HistogramBucketSize = 10
+const HistogramBuckets = 26 // the last bucket holds everything >= 250ms
+const HistogramBarWidth = 50
+
+const DiffColorRange = 50.0 // deltas at or beyond +/- this many milliseconds get full color
+
+const CellFlag_Estimated = 0
+const CellFlag_Measured = 1
+const CellFlag_Filled = 2
+
+func loadLatencyMap(filename string) []float32 {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		panic(fmt.Sprintf("could not read latency map %s: %v", filename, err))
+	}
+	if len(data) != LatencyMapBytes {
+		panic(fmt.Sprintf("latency map %s is invalid size (%d bytes)", filename, len(data)))
+	}
+	index := 0
+	floatArray := make([]float32, LatencyMapSize)
+	for i := 0; i < LatencyMapSize; i++ {
+		integerValue := binary.LittleEndian.Uint32(data[index : index+4])
+		floatArray[i] = math.Float32frombits(integerValue)
+		index += 4
+	}
+	return floatArray
+}
+
+func percentile(sorted []float64, percent float64) float64 {
+	if len(sorted) == 0 {
+		return 0.0
+	}
+	index := int(math.Ceil(percent/100.0*float64(len(sorted)))) - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index]
+}
+
+func printSummary(values []float64, units string) {
+	if len(values) == 0 {
+		fmt.Printf("    no samples\n")
+		return
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	sum := 0.0
+	for i := range sorted {
+		sum += sorted[i]
+	}
+	fmt.Printf("    min:  %8.1f%s\n", sorted[0], units)
+	fmt.Printf("    mean: %8.1f%s\n", sum/float64(len(sorted)), units)
+	fmt.Printf("    p50:  %8.1f%s\n", percentile(sorted, 50), units)
+	fmt.Printf("    p90:  %8.1f%s\n", percentile(sorted, 90), units)
+	fmt.Printf("    p99:  %8.1f%s\n", percentile(sorted, 99), units)
+	fmt.Printf("    max:  %8.1f%s\n", sorted[len(sorted)-1], units)
+}
+
+func inspect(filename string) {
+
+	latencyMap := loadLatencyMap(filename)
+
+	values := make([]float64, 0, LatencyMapSize)
+	for i := 0; i < LatencyMapSize; i++ {
+		if latencyMap[i] > 0.0 {
+			values = append(values, float64(latencyMap[i]))
+		}
+	}
+
+	fmt.Printf("%s\n\n", filename)
+
+	fmt.Printf("coverage: %d/%d cells (%.1f%%)\n\n", len(values), LatencyMapSize, float64(len(values))/LatencyMapSize*100.0)
+
+	// confidence breakdown, if average or transform wrote cell flags and sample counts alongside the map
+
+	basename := strings.TrimSuffix(filename, ".bin")
+
+	flags, err := os.ReadFile(basename + "_flags.bin")
+	if err == nil && len(flags) == LatencyMapSize {
+		var numByFlag [3]int
+		for i := range flags {
+			if int(flags[i]) < len(numByFlag) {
+				numByFlag[flags[i]]++
+			}
+		}
+		fmt.Printf("measured:  %7d cells\n", numByFlag[CellFlag_Measured])
+		fmt.Printf("filled:    %7d cells\n", numByFlag[CellFlag_Filled])
+		fmt.Printf("estimated: %7d cells\n\n", numByFlag[CellFlag_Estimated])
+	}
+
+	if _, err := os.Stat(basename + "_samples.bin"); err == nil {
+		samplesMap := loadLatencyMap(basename + "_samples.bin")
+		samples := make([]float64, 0, LatencyMapSize)
+		for i := 0; i < LatencyMapSize; i++ {
+			if samplesMap[i] > 0.0 {
+				samples = append(samples, float64(samplesMap[i]))
+			}
+		}
+		fmt.Printf("samples per measured cell:\n")
+		printSummary(samples, "")
+		fmt.Printf("\n")
+	}
+
+	fmt.Printf("latency:\n")
+	printSummary(values, "ms")
+
+	if len(values) == 0 {
+		return
+	}
+
+	// histogram of non-zero cells in fixed size latency buckets
+
+	var histogram [HistogramBuckets]int
+	for i := range values {
+		bucket := int(values[i]) / HistogramBucketSize
+		if bucket >= HistogramBuckets {
+			bucket = HistogramBuckets - 1
+		}
+		histogram[bucket]++
+	}
+
+	maxCount := 0
+	for i := range histogram {
+		if histogram[i] > maxCount {
+			maxCount = histogram[i]
+		}
+	}
+
+	fmt.Printf("\nhistogram:\n")
+	for i := range histogram {
+		label := fmt.Sprintf("%3d-%3dms", i*HistogramBucketSize, (i+1)*HistogramBucketSize)
+		if i == HistogramBuckets-1 {
+			label = fmt.Sprintf("%3dms+   ", i*HistogramBucketSize)
+		}
+		bar := strings.Repeat("#", histogram[i]*HistogramBarWidth/maxCount)
+		fmt.Printf("    %s %7d %s\n", label, histogram[i], bar)
+	}
+}
+
+func diff(beforeFilename string, afterFilename string) {
+
+	before := loadLatencyMap(beforeFilename)
+	after := loadLatencyMap(afterFilename)
+
+	fmt.Printf("%s -> %s\n\n", beforeFilename, afterFilename)
+
+	// write per-cell deltas for every cell that has a value in either map
+
+	deltasFile, err := os.Create("diff.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	defer deltasFile.Close()
+
+	fmt.Fprintf(deltasFile, "latitude,longitude,before,after,delta\n")
+
+	deltas := make([]float64, 0, LatencyMapSize)
+	absoluteDeltas := make([]float64, 0, LatencyMapSize)
+
+	numBoth := 0
+	numGained := 0
+	numLost := 0
+	numBetter := 0
+	numWorse := 0
+
+	for y := 0; y < LatencyMapHeight; y++ {
+		for x := 0; x < LatencyMapWidth; x++ {
+			index := x + y*LatencyMapWidth
+			a := before[index]
+			b := after[index]
+			if a <= 0.0 && b <= 0.0 {
+				continue
+			}
+			latitude := MaxLatitude - y
+			longitude := MinLongitude + x
+			if a > 0.0 && b > 0.0 {
+				delta := float64(b - a)
+				deltas = append(deltas, delta)
+				absoluteDeltas = append(absoluteDeltas, math.Abs(delta))
+				numBoth++
+				if delta < 0.0 {
+					numBetter++
+				} else if delta > 0.0 {
+					numWorse++
+				}
+				fmt.Fprintf(deltasFile, "%d,%d,%.1f,%.1f,%.1f\n", latitude, longitude, a, b, delta)
+			} else if b > 0.0 {
+				numGained++
+				fmt.Fprintf(deltasFile, "%d,%d,,%.1f,\n", latitude, longitude, b)
+			} else {
+				numLost++
+				fmt.Fprintf(deltasFile, "%d,%d,%.1f,,\n", latitude, longitude, a)
+			}
+		}
+	}
+
+	fmt.Printf("cells in both:      %7d\n", numBoth)
+	fmt.Printf("cells gained:       %7d\n", numGained)
+	fmt.Printf("cells lost:         %7d\n", numLost)
+	fmt.Printf("cells better:       %7d\n", numBetter)
+	fmt.Printf("cells worse:        %7d\n", numWorse)
+	fmt.Printf("cells unchanged:    %7d\n\n", numBoth-numBetter-numWorse)
+
+	fmt.Printf("delta (after - before):\n")
+	printSummary(deltas, "ms")
+
+	fmt.Printf("\nabsolute delta:\n")
+	printSummary(absoluteDeltas, "ms")
+
+	// write out as diverging color png. blue is lower latency, red is higher latency, yellow is coverage that only exists in one map
+
+	imageData := image.NewRGBA(image.Rectangle{image.Point{0, 0}, image.Point{LatencyMapWidth, LatencyMapHeight}})
+
+	for x := 0; x < LatencyMapWidth; x++ {
+		for y := 0; y < LatencyMapHeight; y++ {
+			index := y*LatencyMapWidth + x
+			a := before[index]
+			b := after[index]
+			if a <= 0.0 && b <= 0.0 {
+				imageData.Set(x, y, color.RGBA{0, 0, 0, 255})
+			} else if a <= 0.0 || b <= 0.0 {
+				imageData.Set(x, y, color.RGBA{255, 255, 0, 255})
+			} else {
+				t := float64(b-a) / DiffColorRange
+				if t > 1.0 {
+					t = 1.0
+				} else if t < -1.0 {
+					t = -1.0
+				}
+				if t >= 0.0 {
+					fade := uint8(255 * (1.0 - t))
+					imageData.Set(x, y, color.RGBA{255, fade, fade, 255})
+				} else {
+					fade := uint8(255 * (1.0 + t))
+					imageData.Set(x, y, color.RGBA{fade, fade, 255, 255})
+				}
+			}
+		}
+	}
+
+	imageFile, err := os.Create("diff.png")
+	if err != nil {
+		panic(err)
+	}
+
+	defer imageFile.Close()
+
+	png.Encode(imageFile, imageData)
+
+	fmt.Printf("\nwrote diff.csv and diff.png\n")
+}
+
+func main() {
+
+	args := os.Args[1:]
+
+	if len(args) == 1 {
+		inspect(args[0])
+	} else if len(args) == 3 && args[0] == "diff" {
+		diff(args[1], args[2])
+	} else {
+		fmt.Printf("usage: inspect <latency_map.bin>\n")
+		fmt.Printf("       inspect diff <before.bin> <after.bin>\n")
+		os.Exit(1)
+	}
+}
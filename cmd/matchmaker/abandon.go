@@ -0,0 +1,112 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AbandonmentPoint is the chance per second that a player still searching at this search time quits the queue
+type AbandonmentPoint struct {
+	searchTime float64
+	hazard     float64
+}
+
+// DefaultAbandonmentCurve is a rough guess. calibrate your own from queue logs: hazard(t) = players who quit at t / players still searching at t
+var DefaultAbandonmentCurve = []AbandonmentPoint{
+	{searchTime: 0, hazard: 0.0},
+	{searchTime: 5, hazard: 0.002},
+	{searchTime: 10, hazard: 0.005},
+	{searchTime: 20, hazard: 0.01},
+	{searchTime: 30, hazard: 0.02},
+	{searchTime: 60, hazard: 0.03},
+}
+
+var abandonmentCurve []AbandonmentPoint
+
+// abandonmentHazard linearly interpolates the curve. search times past the last point use the last hazard
+func abandonmentHazard(searchTime float64) float64 {
+	n := len(abandonmentCurve)
+	if searchTime <= abandonmentCurve[0].searchTime {
+		return abandonmentCurve[0].hazard
+	}
+	if searchTime >= abandonmentCurve[n-1].searchTime {
+		return abandonmentCurve[n-1].hazard
+	}
+	i := sort.Search(n, func(i int) bool { return abandonmentCurve[i].searchTime > searchTime })
+	a := abandonmentCurve[i-1]
+	b := abandonmentCurve[i]
+	t := (searchTime - a.searchTime) / (b.searchTime - a.searchTime)
+	return a.hazard + (b.hazard-a.hazard)*t
+}
+
+func loadAbandonmentCurve(name string) []AbandonmentPoint {
+
+	if name == "" || name == "off" {
+		return nil
+	}
+
+	if name == "default" {
+		return DefaultAbandonmentCurve
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		panic(err)
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	curve := make([]AbandonmentPoint, 0)
+
+	for scanner.Scan() {
+		values := strings.Split(scanner.Text(), ",")
+		if len(values) != 2 {
+			continue
+		}
+		searchTime, err1 := strconv.ParseFloat(values[0], 64)
+		hazard, err2 := strconv.ParseFloat(values[1], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		curve = append(curve, AbandonmentPoint{searchTime: searchTime, hazard: hazard})
+	}
+
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	if len(curve) == 0 {
+		panic(fmt.Sprintf("abandonment curve %s has no points", name))
+	}
+
+	sort.Slice(curve, func(i, j int) bool { return curve[i].searchTime < curve[j].searchTime })
+
+	fmt.Printf("loaded abandonment curve %s\n", name)
+
+	return curve
+}
@@ -0,0 +1,339 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	Adaptive latency thresholds.
+
+	Players belong to the region of their best datacenter. Every AdaptiveInterval seconds the controller estimates the
+	wait in each region from the average number of players searching and the rate they get matched (Little's law), then
+	loosens the region's thresholds when the wait is above target and tightens them when it is below. Warm body fill
+	ignores thresholds, so thresholds that are too tight show up as players matched as warm bodies at high latency
+	rather than as long waits. The controller also loosens whenever too many players are matched as warm bodies.
+	Optionally it also shortens or lengthens IdealTime and ExpandTime. Thresholds are for the default mode, and other
+	modes scale their own thresholds by the same ratio.
+
+	The thresholds chosen over time are logged to thresholds.csv, and the average per region and UTC hour is written
+	to threshold_schedule.csv at shutdown. Pass that file back in with -adaptive to replay it as a fixed schedule.
+*/
+
+const AdaptiveInterval = 300
+const AdaptiveDeadband = 0.1 // no change while the estimated wait is within 10% of target
+const AdaptiveLoosenFactor = 1.1
+const AdaptiveTightenFactor = 0.95
+const AdaptiveMaxWarmBodyPercent = 5.0 // loosen when more than this percent of matched players were warm bodies
+
+const MinIdealCostThreshold = 20
+const MaxIdealCostThreshold = 150
+const MinExpandCostGap = 10 // expand threshold is always at least this much above ideal
+const MaxExpandCostThreshold = 250
+const MinSearchStageTime = 2
+const MaxSearchStageTime = 30
+
+const Adaptive_Off = 0
+const Adaptive_Thresholds = 1
+const Adaptive_All = 2 // thresholds and search stage times
+const Adaptive_Schedule = 3
+
+type RegionThresholds struct {
+	name                string
+	idealCostThreshold  float64
+	expandCostThreshold float64
+	idealTime           int
+	expandTime          int
+	searching           int // player seconds spent searching this interval
+	matched             int
+	warmBodies          int // players matched this interval while in the warm body stage
+	searchTime          float64
+	schedule            [24]ScheduleEntry // learned, or loaded for replay
+}
+
+type ScheduleEntry struct {
+	samples             int
+	idealCostThreshold  float64
+	expandCostThreshold float64
+	idealTime           float64
+	expandTime          float64
+}
+
+var adaptiveMode int
+
+var regionThresholds map[string]*RegionThresholds
+
+var thresholdsFile *os.File
+
+func initializeAdaptiveThresholds(value string) {
+
+	regionThresholds = make(map[string]*RegionThresholds)
+
+	switch value {
+	case "", "off":
+		adaptiveMode = Adaptive_Off
+		return
+	case "thresholds":
+		adaptiveMode = Adaptive_Thresholds
+	case "all":
+		adaptiveMode = Adaptive_All
+	default:
+		adaptiveMode = Adaptive_Schedule
+		loadThresholdSchedule(value)
+		return
+	}
+
+	var err error
+	thresholdsFile, err = os.Create("thresholds.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprintf(thresholdsFile, "time,region,idealThreshold,expandThreshold,idealTime,expandTime,searching,matchRate,waitEstimate,searchTime,warmBodyPercent\n")
+}
+
+func getRegionThresholds(name string) *RegionThresholds {
+	region, ok := regionThresholds[name]
+	if !ok {
+		region = &RegionThresholds{name: name, idealCostThreshold: IdealCostThreshold, expandCostThreshold: ExpandCostThreshold, idealTime: IdealTime, expandTime: ExpandTime}
+		regionThresholds[name] = region
+	}
+	return region
+}
+
+// assignThresholdRegion puts the player in the region of their best allowed datacenter
+func assignThresholdRegion(player *ActivePlayer) {
+	if adaptiveMode == Adaptive_Off || len(player.datacenterCosts) == 0 {
+		return
+	}
+	player.thresholds = getRegionThresholds(datacenterRegion(player.datacenterCosts[0].datacenterId))
+}
+
+func idealCostThreshold(player *ActivePlayer, mode int) float64 {
+	if player.thresholds == nil {
+		return gameModes[mode].idealCostThreshold
+	}
+	return gameModes[mode].idealCostThreshold * player.thresholds.idealCostThreshold / IdealCostThreshold
+}
+
+func expandCostThreshold(player *ActivePlayer, mode int) float64 {
+	if player.thresholds == nil {
+		return gameModes[mode].expandCostThreshold
+	}
+	return gameModes[mode].expandCostThreshold * player.thresholds.expandCostThreshold / ExpandCostThreshold
+}
+
+func idealTime(player *ActivePlayer) int {
+	if player.thresholds == nil {
+		return IdealTime
+	}
+	return player.thresholds.idealTime
+}
+
+func expandTime(player *ActivePlayer) int {
+	if player.thresholds == nil {
+		return ExpandTime
+	}
+	return player.thresholds.expandTime
+}
+
+func clampThresholds(region *RegionThresholds) {
+	region.idealCostThreshold = math.Max(MinIdealCostThreshold, math.Min(MaxIdealCostThreshold, region.idealCostThreshold))
+	region.expandCostThreshold = math.Max(region.idealCostThreshold+MinExpandCostGap, math.Min(MaxExpandCostThreshold, region.expandCostThreshold))
+	if region.idealTime < MinSearchStageTime {
+		region.idealTime = MinSearchStageTime
+	} else if region.idealTime > MaxSearchStageTime {
+		region.idealTime = MaxSearchStageTime
+	}
+	if region.expandTime < MinSearchStageTime {
+		region.expandTime = MinSearchStageTime
+	} else if region.expandTime > MaxSearchStageTime {
+		region.expandTime = MaxSearchStageTime
+	}
+}
+
+// updateAdaptiveThresholds runs every second. in schedule mode it applies the schedule for the current hour, otherwise
+// it runs the controller at the end of each interval
+func updateAdaptiveThresholds(seconds uint64, timeString string) {
+
+	if adaptiveMode == Adaptive_Off {
+		return
+	}
+
+	hour := int(seconds%SecondsPerDay) / 3600
+
+	if adaptiveMode == Adaptive_Schedule {
+		if seconds%3600 == 0 {
+			for _, region := range regionThresholds {
+				entry := &region.schedule[hour]
+				if entry.samples == 0 {
+					continue
+				}
+				region.idealCostThreshold = entry.idealCostThreshold
+				region.expandCostThreshold = entry.expandCostThreshold
+				region.idealTime = int(math.Round(entry.idealTime))
+				region.expandTime = int(math.Round(entry.expandTime))
+			}
+		}
+		return
+	}
+
+	if (seconds+1)%AdaptiveInterval != 0 {
+		return
+	}
+
+	names := make([]string, 0, len(regionThresholds))
+	for name := range regionThresholds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+
+		region := regionThresholds[name]
+
+		searching := float64(region.searching) / AdaptiveInterval
+		matchRate := float64(region.matched) / AdaptiveInterval
+		searchTime := 0.0
+		warmBodyPercent := 0.0
+		if region.matched > 0 {
+			searchTime = region.searchTime / float64(region.matched)
+			warmBodyPercent = float64(region.warmBodies) / float64(region.matched) * 100.0
+		}
+
+		// little's law: average players searching = arrival rate into matches * average wait
+
+		waitEstimate := math.Inf(1)
+		if matchRate > 0.0 {
+			waitEstimate = searching / matchRate
+		}
+
+		if searching > 0.0 {
+			if waitEstimate > *targetSearchTime*(1.0+AdaptiveDeadband) || warmBodyPercent > AdaptiveMaxWarmBodyPercent {
+				region.idealCostThreshold *= AdaptiveLoosenFactor
+				region.expandCostThreshold *= AdaptiveLoosenFactor
+				if adaptiveMode == Adaptive_All {
+					region.idealTime--
+					region.expandTime--
+				}
+			} else if waitEstimate < *targetSearchTime*(1.0-AdaptiveDeadband) {
+				region.idealCostThreshold *= AdaptiveTightenFactor
+				region.expandCostThreshold *= AdaptiveTightenFactor
+				if adaptiveMode == Adaptive_All {
+					region.idealTime++
+					region.expandTime++
+				}
+			}
+			clampThresholds(region)
+		}
+
+		fmt.Fprintf(thresholdsFile, "%s,%s,%.1f,%.1f,%d,%d,%.1f,%.2f,%.2f,%.2f,%.1f\n", timeString, region.name, region.idealCostThreshold, region.expandCostThreshold, region.idealTime, region.expandTime, searching, matchRate, waitEstimate, searchTime, warmBodyPercent)
+
+		entry := &region.schedule[hour]
+		entry.samples++
+		entry.idealCostThreshold += region.idealCostThreshold
+		entry.expandCostThreshold += region.expandCostThreshold
+		entry.idealTime += float64(region.idealTime)
+		entry.expandTime += float64(region.expandTime)
+
+		region.searching = 0
+		region.matched = 0
+		region.warmBodies = 0
+		region.searchTime = 0.0
+	}
+}
+
+// writeThresholdSchedule writes the average thresholds the controller chose for each region and UTC hour
+func writeThresholdSchedule() {
+
+	if thresholdsFile == nil {
+		return
+	}
+
+	thresholdsFile.Close()
+
+	f, err := os.Create("threshold_schedule.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	defer f.Close()
+
+	names := make([]string, 0, len(regionThresholds))
+	for name := range regionThresholds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		region := regionThresholds[name]
+		for hour := range region.schedule {
+			entry := &region.schedule[hour]
+			if entry.samples == 0 {
+				continue
+			}
+			n := float64(entry.samples)
+			fmt.Fprintf(f, "%s,%d,%.1f,%.1f,%.1f,%.1f\n", name, hour, entry.idealCostThreshold/n, entry.expandCostThreshold/n, entry.idealTime/n, entry.expandTime/n)
+		}
+	}
+}
+
+// loadThresholdSchedule reads rows of region,hour,idealThreshold,expandThreshold,idealTime,expandTime as written by writeThresholdSchedule
+func loadThresholdSchedule(filename string) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		values := strings.Split(scanner.Text(), ",")
+		if len(values) != 6 {
+			continue
+		}
+		hour, err1 := strconv.Atoi(values[1])
+		idealThreshold, err2 := strconv.ParseFloat(values[2], 64)
+		expandThreshold, err3 := strconv.ParseFloat(values[3], 64)
+		idealTime, err4 := strconv.ParseFloat(values[4], 64)
+		expandTime, err5 := strconv.ParseFloat(values[5], 64)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || err5 != nil || hour < 0 || hour > 23 {
+			continue
+		}
+		region := getRegionThresholds(values[0])
+		region.schedule[hour] = ScheduleEntry{samples: 1, idealCostThreshold: idealThreshold, expandCostThreshold: expandThreshold, idealTime: idealTime, expandTime: expandTime}
+	}
+
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("loaded threshold schedule for %d regions from %s\n", len(regionThresholds), filename)
+}
@@ -0,0 +1,97 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// runAdaptiveInterval runs the controller once for a region that averaged this many players searching and matched per second
+func runAdaptiveInterval(mode int, region *RegionThresholds, searching float64, matched float64, warmBodies int) {
+	adaptiveMode = mode
+	defer func() { adaptiveMode = Adaptive_Off }()
+	regionThresholds = map[string]*RegionThresholds{region.name: region}
+	region.searching = int(searching * AdaptiveInterval)
+	region.matched = int(matched * AdaptiveInterval)
+	region.warmBodies = warmBodies
+	updateAdaptiveThresholds(AdaptiveInterval-1, "")
+}
+
+func checkThresholds(t *testing.T, region *RegionThresholds, ideal float64, expand float64, idealTime int, expandTime int) {
+	t.Helper()
+	if math.Abs(region.idealCostThreshold-ideal) > 1e-9 || math.Abs(region.expandCostThreshold-expand) > 1e-9 {
+		t.Fatalf("thresholds are %.2f and %.2f, expected %.2f and %.2f", region.idealCostThreshold, region.expandCostThreshold, ideal, expand)
+	}
+	if region.idealTime != idealTime || region.expandTime != expandTime {
+		t.Fatalf("stage times are %d and %d, expected %d and %d", region.idealTime, region.expandTime, idealTime, expandTime)
+	}
+}
+
+func defaultRegionThresholds() *RegionThresholds {
+	return &RegionThresholds{name: "test", idealCostThreshold: IdealCostThreshold, expandCostThreshold: ExpandCostThreshold, idealTime: IdealTime, expandTime: ExpandTime}
+}
+
+func TestAdaptiveThresholdsLoosen(t *testing.T) {
+
+	// 20 searching and 1 matched per second is a 20 second wait, over the 10 second target
+
+	region := defaultRegionThresholds()
+	runAdaptiveInterval(Adaptive_Thresholds, region, 20, 1, 0)
+	checkThresholds(t, region, IdealCostThreshold*AdaptiveLoosenFactor, ExpandCostThreshold*AdaptiveLoosenFactor, IdealTime, ExpandTime)
+
+	region = defaultRegionThresholds()
+	runAdaptiveInterval(Adaptive_All, region, 20, 1, 0)
+	checkThresholds(t, region, IdealCostThreshold*AdaptiveLoosenFactor, ExpandCostThreshold*AdaptiveLoosenFactor, IdealTime-1, ExpandTime-1)
+}
+
+func TestAdaptiveThresholdsTighten(t *testing.T) {
+
+	// 2 searching and 1 matched per second is a 2 second wait, under the target
+
+	region := defaultRegionThresholds()
+	runAdaptiveInterval(Adaptive_All, region, 2, 1, 0)
+	checkThresholds(t, region, IdealCostThreshold*AdaptiveTightenFactor, ExpandCostThreshold*AdaptiveTightenFactor, IdealTime+1, ExpandTime+1)
+}
+
+func TestAdaptiveThresholdsDeadband(t *testing.T) {
+	region := defaultRegionThresholds()
+	runAdaptiveInterval(Adaptive_All, region, 10, 1, 0)
+	checkThresholds(t, region, IdealCostThreshold, ExpandCostThreshold, IdealTime, ExpandTime)
+}
+
+func TestAdaptiveThresholdsWarmBodies(t *testing.T) {
+
+	// the wait is under target, but too many players were matched as warm bodies
+
+	region := defaultRegionThresholds()
+	runAdaptiveInterval(Adaptive_Thresholds, region, 2, 1, AdaptiveInterval/10)
+	checkThresholds(t, region, IdealCostThreshold*AdaptiveLoosenFactor, ExpandCostThreshold*AdaptiveLoosenFactor, IdealTime, ExpandTime)
+}
+
+func TestAdaptiveThresholdsClamp(t *testing.T) {
+	region := defaultRegionThresholds()
+	region.idealCostThreshold = MaxIdealCostThreshold
+	region.expandCostThreshold = MaxExpandCostThreshold
+	region.idealTime = MinSearchStageTime
+	region.expandTime = MinSearchStageTime
+	runAdaptiveInterval(Adaptive_All, region, 20, 1, 0)
+	checkThresholds(t, region, MaxIdealCostThreshold, MaxExpandCostThreshold, MinSearchStageTime, MinSearchStageTime)
+}
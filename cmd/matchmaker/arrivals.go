@@ -0,0 +1,101 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// binary player arrivals written by the arrivals command. see cmd/arrivals for the format
+
+const ArrivalsMagic = "MMPA"
+const ArrivalsVersion = 1
+const ArrivalsHeaderBytes = 16
+const ArrivalsRecordBytes = 8
+
+var arrivalsData []byte // memory mapped, so only the pages for the seconds being simulated are resident
+
+var arrivalsSeconds uint64
+
+var arrivalsOffsets []byte
+
+var arrivalsRecords []byte
+
+func loadArrivals(filename string) {
+
+	data, err := mapFile(filename)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(data) < ArrivalsHeaderBytes || string(data[0:4]) != ArrivalsMagic {
+		panic(fmt.Sprintf("%s is not a player arrivals file", filename))
+	}
+
+	version := binary.LittleEndian.Uint32(data[4:])
+	if version != ArrivalsVersion {
+		panic(fmt.Sprintf("%s has unsupported version %d", filename, version))
+	}
+
+	sampleDays := binary.LittleEndian.Uint32(data[8:])
+	numSeconds := uint64(binary.LittleEndian.Uint32(data[12:]))
+
+	offsetsEnd := ArrivalsHeaderBytes + (numSeconds+1)*8
+	if numSeconds == 0 || sampleDays == 0 || uint64(len(data)) < offsetsEnd {
+		panic(fmt.Sprintf("player arrivals file %s is truncated", filename))
+	}
+
+	arrivalsOffsets = data[ArrivalsHeaderBytes:offsetsEnd]
+	arrivalsRecords = data[offsetsEnd:]
+
+	numRecords := binary.LittleEndian.Uint64(arrivalsOffsets[numSeconds*8:])
+	if uint64(len(arrivalsRecords)) != numRecords*ArrivalsRecordBytes {
+		panic(fmt.Sprintf("player arrivals file %s is invalid size (%d bytes)", filename, len(data)))
+	}
+
+	arrivalsData = data
+	arrivalsSeconds = numSeconds
+	arrivalSampleDays = float64(sampleDays)
+
+	fmt.Printf("mapped %s: %d arrivals over %d days\n", filename, numRecords, numSeconds/SecondsPerDay)
+}
+
+// getNewPlayerData returns the player arrivals for this second of the simulation. datasets loop when the simulation runs past their end
+func getNewPlayerData(seconds uint64) []NewPlayerData {
+
+	if arrivalsData == nil {
+		return newPlayerData[seconds%SecondsPerDay]
+	}
+
+	index := seconds % arrivalsSeconds
+	begin := binary.LittleEndian.Uint64(arrivalsOffsets[index*8:])
+	end := binary.LittleEndian.Uint64(arrivalsOffsets[(index+1)*8:])
+
+	result := make([]NewPlayerData, end-begin)
+	for i := range result {
+		record := arrivalsRecords[(begin+uint64(i))*ArrivalsRecordBytes:]
+		result[i].latitude = float64(math.Float32frombits(binary.LittleEndian.Uint32(record[0:])))
+		result[i].longitude = float64(math.Float32frombits(binary.LittleEndian.Uint32(record[4:])))
+	}
+
+	return result
+}
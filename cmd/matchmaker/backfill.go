@@ -0,0 +1,238 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"os"
+)
+
+/*
+	Mid-match leavers and backfill.
+
+	When a player joins a match they may be scheduled to leave part way through, which leaves the game entirely. The
+	open slot can be backfilled from players searching in the same mode on the same datacenter, as long as their cost
+	to the datacenter is under the backfill threshold and the match isn't about to end.
+*/
+
+const BackfillCostThreshold = 80
+const BackfillCutoffSeconds = 60 // matches this close to the end are not backfilled
+
+var leaveQueue PlayerPriorityQueue
+
+var lastLeave *PlayerData
+
+var openMatches []*MatchData // matches with open slots that may still be backfilled
+
+var backfillFile *os.File
+
+var numFinishedMatches int
+var numLeavers int
+var numBackfilled int
+var numUnfilled int
+var backfillWaitTime float64
+var matchSeconds float64
+var shortHandedSeconds float64
+
+func initializeBackfill() {
+
+	heap.Init(&leaveQueue)
+
+	if *leavePercent <= 0.0 {
+		return
+	}
+
+	var err error
+	backfillFile, err = os.Create("backfill.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprintf(backfillFile, "time,matches,leavers,backfilled,unfilled,backfillRate,backfillWait,shortHanded\n")
+}
+
+// scheduleLeave decides whether a player who just joined a match will leave it early. players who join part way
+// through have a proportionally lower chance to leave
+func scheduleLeave(seconds uint64, match *MatchData, player *ActivePlayer) {
+	if *leavePercent <= 0.0 || match.priority < seconds+2 {
+		return
+	}
+	remaining := match.priority - seconds
+	chance := *leavePercent * float64(remaining) / float64(gameModes[match.mode].matchLengthSeconds)
+	if rand.Float64()*100.0 >= chance {
+		return
+	}
+	leaveTime := seconds + 1 + uint64(rand.Int63n(int64(remaining-1)))
+	heap.Push(&leaveQueue, &PlayerData{priority: leaveTime, player: player})
+}
+
+// processLeavers removes players from their matches when their leave time comes up, opening a slot for backfill
+func processLeavers(seconds uint64) {
+
+	for {
+
+		if lastLeave == nil && len(leaveQueue) > 0 {
+			lastLeave = heap.Pop(&leaveQueue).(*PlayerData)
+		}
+
+		if lastLeave == nil || lastLeave.priority > seconds {
+			break
+		}
+
+		player := lastLeave.player
+		match := player.match
+
+		lastLeave = nil
+
+		if player.state != PlayerState_Playing || match == nil {
+			continue
+		}
+
+		for i := range match.players {
+			if match.players[i] == player {
+				match.players[i] = match.players[len(match.players)-1]
+				match.players = match.players[:len(match.players)-1]
+				break
+			}
+		}
+
+		index := getPlayerMapIndex(player)
+		countData[index]--
+		delete(inGamePlayers, player.playerId)
+		datacenters[match.datacenterId].load.playing--
+		player.state = PlayerState_Left
+		endPersistentSession(player, SessionEnd_Left)
+
+		numLeavers++
+
+		if len(match.openSlots) == 0 {
+			match.shortSince = seconds
+		}
+		match.openSlots = append(match.openSlots, seconds)
+
+		if *backfillEnabled && len(match.openSlots) == 1 && seconds+BackfillCutoffSeconds < match.priority {
+			openMatches = append(openMatches, match)
+		}
+	}
+}
+
+func datacenterCost(player *ActivePlayer, datacenterId uint64) (float64, bool) {
+	for i := range player.datacenterCosts {
+		if player.datacenterCosts[i].datacenterId == datacenterId {
+			return player.datacenterCosts[i].cost, true
+		}
+	}
+	return 0.0, false
+}
+
+// backfill fills open slots from players searching in the match's mode on the match's datacenter
+func backfill(seconds uint64) {
+
+	stillOpen := openMatches[:0]
+
+	for _, match := range openMatches {
+
+		if len(match.openSlots) == 0 || seconds+BackfillCutoffSeconds >= match.priority {
+			continue
+		}
+
+		datacenter := datacenters[match.datacenterId]
+		queue := datacenter.playerQueues[match.mode]
+
+		for i := 0; i < len(queue) && len(match.openSlots) > 0; i++ {
+
+			player := queue[i]
+
+			if player.state != PlayerState_Ideal && player.state != PlayerState_Expand && player.state != PlayerState_WarmBody {
+				continue
+			}
+
+			cost, ok := datacenterCost(player, match.datacenterId)
+			if !ok || cost > BackfillCostThreshold {
+				continue
+			}
+
+			if compatible, rejectedBy := constraintsAllow(player, match.players); !compatible {
+				recordBlocked(rejectedBy)
+				continue
+			}
+
+			if !spreadAllows(player, match.players, match.datacenterId, match.mode) {
+				continue
+			}
+
+			numBackfilled++
+			backfillWaitTime += float64(seconds - match.openSlots[0])
+			match.openSlots = match.openSlots[1:]
+
+			joinMatch(seconds, match, datacenter, player)
+
+			if len(match.openSlots) == 0 {
+				match.shortSeconds += seconds - match.shortSince
+			}
+		}
+
+		if len(match.openSlots) > 0 {
+			stillOpen = append(stillOpen, match)
+		}
+	}
+
+	openMatches = stillOpen
+}
+
+// finishMatch takes the match's players off the datacenter load and records how much of the match was played with open slots
+func finishMatch(seconds uint64, match *MatchData) {
+	datacenters[match.datacenterId].load.playing -= len(match.players)
+	if len(match.openSlots) > 0 {
+		match.shortSeconds += seconds - match.shortSince
+		numUnfilled += len(match.openSlots)
+	}
+	numFinishedMatches++
+	matchSeconds += float64(match.priority - match.start)
+	shortHandedSeconds += float64(match.shortSeconds)
+}
+
+func writeBackfillStats(timeString string) {
+	if backfillFile == nil {
+		return
+	}
+	backfillRate := 0.0
+	averageWait := 0.0
+	if numLeavers > 0 {
+		backfillRate = float64(numBackfilled) / float64(numLeavers) * 100.0
+	}
+	if numBackfilled > 0 {
+		averageWait = backfillWaitTime / float64(numBackfilled)
+	}
+	shortHanded := 0.0
+	if matchSeconds > 0.0 {
+		shortHanded = shortHandedSeconds / matchSeconds * 100.0
+	}
+	fmt.Fprintf(backfillFile, "%s,%d,%d,%d,%d,%.1f,%.1f,%.2f\n", timeString, numFinishedMatches, numLeavers, numBackfilled, numUnfilled, backfillRate, averageWait, shortHanded)
+	numFinishedMatches = 0
+	numLeavers = 0
+	numBackfilled = 0
+	numUnfilled = 0
+	backfillWaitTime = 0.0
+	matchSeconds = 0.0
+	shortHandedSeconds = 0.0
+}
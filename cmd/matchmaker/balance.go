@@ -0,0 +1,170 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+/*
+	Load aware datacenter selection.
+
+	A player joins the queue of every datacenter under their threshold, so which one they end up playing on depends on
+	map iteration order and the queue shuffle. With -balance, datacenters that are within the tolerance of a player's
+	best cost compete for them by load instead: the greedy matcher first fills matches in order of least loaded
+	datacenter, taking only players within tolerance of their best datacenter, then fills matches as before from
+	whoever is left. The optimized matcher adds up to the tolerance to each cost in proportion to how loaded the
+	datacenter is, so among datacenters of near equal cost the least loaded wins.
+
+	Load is the number of players currently in matches on a datacenter, relative to the busiest datacenter. With -balance,
+	every hour load.csv reports the average players in matches on each datacenter, its share of all players in matches, and the
+	matches started and players who played somewhere other than their best datacenter.
+*/
+
+type DatacenterLoad struct {
+	playing        int     // players in matches right now
+	playingSeconds float64 // sum of playing over the seconds of the current hour
+	matches        int
+	players        int
+	notBest        int // players who played somewhere other than their best datacenter
+}
+
+var maxPlaying int
+
+var loadSeconds int
+
+var loadFile *os.File
+
+func initializeLoadBalancing() {
+
+	if *balanceTolerance <= 0.0 {
+		return
+	}
+
+	var err error
+	loadFile, err = os.Create("load.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprintf(loadFile, "time,datacenter,region,playing,share,matches,players,notBest\n")
+}
+
+// updateDatacenterLoad samples how loaded each datacenter is before matching
+func updateDatacenterLoad() {
+	maxPlaying = 0
+	for _, datacenter := range datacenters {
+		datacenter.load.playingSeconds += float64(datacenter.load.playing)
+		if datacenter.load.playing > maxPlaying {
+			maxPlaying = datacenter.load.playing
+		}
+	}
+	loadSeconds++
+}
+
+// datacenterUtilization is the datacenter's load relative to the busiest datacenter, from 0 to 1
+func datacenterUtilization(datacenterId uint64) float64 {
+	if maxPlaying == 0 {
+		return 0.0
+	}
+	return float64(datacenters[datacenterId].load.playing) / float64(maxPlaying)
+}
+
+// leastLoadedDatacenters returns datacenter ids from least to most loaded
+func leastLoadedDatacenters() []uint64 {
+	ids := make([]uint64, 0, len(datacenters))
+	for datacenterId := range datacenters {
+		ids = append(ids, datacenterId)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a := datacenters[ids[i]].load.playing
+		b := datacenters[ids[j]].load.playing
+		if a != b {
+			return a < b
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// withinBalanceTolerance is true if the datacenter's cost is within the balance tolerance of the player's best datacenter
+func withinBalanceTolerance(player *ActivePlayer, datacenterId uint64) bool {
+	if len(player.datacenterCosts) == 0 {
+		return false
+	}
+	cost, ok := datacenterCost(player, datacenterId)
+	return ok && cost <= player.datacenterCosts[0].cost+*balanceTolerance
+}
+
+// balancedCost adds up to the balance tolerance to a datacenter cost, in proportion to how loaded the datacenter is
+func balancedCost(datacenterId uint64, cost float64) float64 {
+	if *balanceTolerance <= 0.0 {
+		return cost
+	}
+	return cost + *balanceTolerance*datacenterUtilization(datacenterId)
+}
+
+func recordDatacenterLoad(match *MatchData) {
+	load := &datacenters[match.datacenterId].load
+	load.matches++
+	for _, player := range match.players {
+		load.players++
+		if len(player.datacenterCosts) > 0 && player.datacenterCosts[0].datacenterId != match.datacenterId {
+			load.notBest++
+		}
+	}
+}
+
+func writeLoadStats(timeString string) {
+
+	if loadFile == nil {
+		return
+	}
+
+	ids := make([]uint64, 0, len(datacenters))
+	totalPlaying := 0.0
+	for datacenterId, datacenter := range datacenters {
+		ids = append(ids, datacenterId)
+		totalPlaying += datacenter.load.playingSeconds
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, datacenterId := range ids {
+		datacenter := datacenters[datacenterId]
+		load := &datacenter.load
+		playing := 0.0
+		share := 0.0
+		if loadSeconds > 0 {
+			playing = load.playingSeconds / float64(loadSeconds)
+		}
+		if totalPlaying > 0.0 {
+			share = load.playingSeconds / totalPlaying * 100.0
+		}
+		fmt.Fprintf(loadFile, "%s,%s,%s,%.1f,%.2f,%d,%d,%d\n", timeString, datacenter.name, datacenterRegion(datacenterId), playing, share, load.matches, load.players, load.notBest)
+		load.playingSeconds = 0.0
+		load.matches = 0
+		load.players = 0
+		load.notBest = 0
+	}
+
+	loadSeconds = 0
+}
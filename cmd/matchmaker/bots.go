@@ -0,0 +1,178 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+/*
+	Bot fill.
+
+	With bot fill, a player whose search times out at the end of the last stage is put in a match completed with bots
+	instead of failing. Search stages with the bots rule do the same when they run out, and optionally any player who
+	has searched for -botwait seconds is bot filled too. Players waiting for bot fill in the
+	same mode are grouped into one lobby where they are compatible, and the lobby plays on the datacenter with the
+	lowest average latency for its humans. Players with no allowed datacenter still fail.
+
+	Every hour bots.csv reports matches, bot matches, humans, bots and the bot ratio for each datacenter region.
+*/
+
+type BotStats struct {
+	matches    int
+	botMatches int
+	humans     int
+	bots       int
+}
+
+var botFillPlayers []*ActivePlayer // players to bot fill this tick
+
+var botStats map[string]*BotStats
+
+var botsFile *os.File
+
+func botFillEnabled() bool {
+	return *botFill || *botWaitSeconds > 0.0
+}
+
+func initializeBots() {
+
+	botStats = make(map[string]*BotStats)
+
+	if !botFillEnabled() {
+		return
+	}
+
+	var err error
+	botsFile, err = os.Create("bots.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprintf(botsFile, "time,region,matches,botMatches,humans,bots,botRatio\n")
+}
+
+// waitedForBots is true when a searching player has searched long enough to be bot filled before their search times out
+func waitedForBots(player *ActivePlayer) bool {
+	return *botWaitSeconds > 0.0 && player.matchingTime >= *botWaitSeconds && len(player.datacenterCosts) > 0
+}
+
+// bestBotDatacenter returns the datacenter with the lowest average latency that every human in the lobby can play on
+func bestBotDatacenter(players []*ActivePlayer) uint64 {
+	bestId := players[0].datacenterCosts[0].datacenterId
+	bestLatency := math.Inf(1)
+	for _, entry := range players[0].datacenterCosts {
+		total := 0.0
+		allowed := true
+		for _, player := range players {
+			if _, ok := datacenterCost(player, entry.datacenterId); !ok {
+				allowed = false
+				break
+			}
+			total += matchLatency(player, entry.datacenterId)
+		}
+		if allowed && total < bestLatency {
+			bestId = entry.datacenterId
+			bestLatency = total
+		}
+	}
+	return bestId
+}
+
+// runBotFill starts a bot filled match for every player waiting for bot fill, longest waiting first
+func runBotFill(seconds uint64) {
+
+	players := botFillPlayers
+	botFillPlayers = botFillPlayers[:0]
+
+	sort.SliceStable(players, func(i, j int) bool { return players[i].matchingTime > players[j].matchingTime })
+
+	for i, anchor := range players {
+
+		if !searching(anchor) {
+			continue
+		}
+
+		mode := anchor.modes[0]
+		anchorId := anchor.datacenterCosts[0].datacenterId
+		lobby := []*ActivePlayer{anchor}
+
+		for _, player := range players[i+1:] {
+			if len(lobby) == gameModes[mode].playersPerMatch {
+				break
+			}
+			if !searching(player) || player.modes[0] != mode {
+				continue
+			}
+			if _, ok := datacenterCost(player, anchorId); !ok {
+				continue
+			}
+			if compatible, _ := constraintsAllow(player, lobby); !compatible {
+				continue
+			}
+			if !spreadAllows(player, lobby, anchorId, mode) {
+				continue
+			}
+			lobby = append(lobby, player)
+		}
+
+		datacenterId := bestBotDatacenter(lobby)
+
+		startMatch(seconds, mode, datacenterId, datacenters[datacenterId], lobby, gameModes[mode].playersPerMatch-len(lobby))
+	}
+}
+
+func recordBotMatch(match *MatchData) {
+	region := datacenterRegion(match.datacenterId)
+	stats, ok := botStats[region]
+	if !ok {
+		stats = &BotStats{}
+		botStats[region] = stats
+	}
+	stats.matches++
+	stats.humans += len(match.players)
+	stats.bots += match.bots
+	if match.bots > 0 {
+		stats.botMatches++
+	}
+}
+
+func writeBotStats(timeString string) {
+	if botsFile == nil {
+		return
+	}
+	regions := make([]string, 0, len(botStats))
+	for region := range botStats {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	for _, region := range regions {
+		stats := botStats[region]
+		botRatio := 0.0
+		if stats.humans+stats.bots > 0 {
+			botRatio = float64(stats.bots) / float64(stats.humans+stats.bots) * 100.0
+		}
+		fmt.Fprintf(botsFile, "%s,%s,%d,%d,%d,%d,%.2f\n", timeString, region, stats.matches, stats.botMatches, stats.humans, stats.bots, botRatio)
+		*stats = BotStats{}
+	}
+}
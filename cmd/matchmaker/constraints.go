@@ -0,0 +1,247 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+const Platform_PC = 0
+const Platform_PlayStation = 1
+const Platform_Xbox = 2
+
+const InputDevice_KeyboardMouse = 0
+const InputDevice_Controller = 1
+
+var PlatformPercent = []int{55, 30, 15} // pc, playstation, xbox
+
+const PCKeyboardMousePercent = 80 // consoles always use controllers
+const CrossplayOptInPercent = 75
+
+const LanguageRelaxSeconds = 10
+const InputDeviceRelaxSeconds = 5
+
+type PlayerAttributes struct {
+	platform    int
+	inputDevice int
+	language    string
+	crossplay   bool // the player allows matches across the pc and console pools
+}
+
+type LanguageWeight struct {
+	language string
+	percent  int
+}
+
+type LanguageRegion struct {
+	minLatitude  float64
+	maxLatitude  float64
+	minLongitude float64
+	maxLongitude float64
+	languages    []LanguageWeight
+}
+
+// language mix by region. the first region that contains the player wins, and players outside every region speak english
+var LanguageRegions = []LanguageRegion{
+	{minLatitude: 15, maxLatitude: 90, minLongitude: -180, maxLongitude: -50, languages: []LanguageWeight{{"en", 80}, {"es", 12}, {"fr", 8}}},
+	{minLatitude: -90, maxLatitude: 15, minLongitude: -120, maxLongitude: -30, languages: []LanguageWeight{{"es", 55}, {"pt", 40}, {"en", 5}}},
+	{minLatitude: 35, maxLatitude: 72, minLongitude: -25, maxLongitude: 45, languages: []LanguageWeight{{"en", 25}, {"de", 20}, {"fr", 18}, {"es", 15}, {"it", 10}, {"pl", 7}, {"nl", 5}}},
+	{minLatitude: -10, maxLatitude: 60, minLongitude: 60, maxLongitude: 150, languages: []LanguageWeight{{"en", 30}, {"zh", 30}, {"ja", 25}, {"ko", 15}}},
+}
+
+func randomAttributes(latitude float64, longitude float64) PlayerAttributes {
+
+	attributes := PlayerAttributes{}
+
+	value := randomInt(1, 100)
+	for platform := range PlatformPercent {
+		if value <= PlatformPercent[platform] {
+			attributes.platform = platform
+			break
+		}
+		value -= PlatformPercent[platform]
+	}
+
+	attributes.inputDevice = InputDevice_Controller
+	if attributes.platform == Platform_PC && percentChance(PCKeyboardMousePercent) {
+		attributes.inputDevice = InputDevice_KeyboardMouse
+	}
+
+	attributes.crossplay = percentChance(CrossplayOptInPercent)
+
+	attributes.language = "en"
+	for i := range LanguageRegions {
+		region := &LanguageRegions[i]
+		if latitude >= region.minLatitude && latitude <= region.maxLatitude && longitude >= region.minLongitude && longitude <= region.maxLongitude {
+			value := rand.Intn(100)
+			for _, weight := range region.languages {
+				if value < weight.percent {
+					attributes.language = weight.language
+					break
+				}
+				value -= weight.percent
+			}
+			break
+		}
+	}
+
+	return attributes
+}
+
+// ---------------------------------------------------------------------------------------------------------------------------
+
+// MatchConstraint decides whether two players can be in the same match. hard constraints always apply. soft preferences
+// stop applying once both players have searched for at least relaxTime seconds
+type MatchConstraint struct {
+	name       string
+	relaxTime  float64 // zero for hard constraints
+	compatible func(a *ActivePlayer, b *ActivePlayer) bool
+	blocked    int
+	players    int
+	searchTime float64
+}
+
+var AllMatchConstraints = []*MatchConstraint{
+	{name: "crossplay", compatible: crossplayCompatible},
+	{name: "language", relaxTime: LanguageRelaxSeconds, compatible: sameLanguage},
+	{name: "input", relaxTime: InputDeviceRelaxSeconds, compatible: sameInputDevice},
+}
+
+var matchConstraints []*MatchConstraint
+
+var constraintsFile *os.File
+
+var unconstrainedPlayers int
+
+var unconstrainedSearchTime float64
+
+// console players are pooled together and pc players are pooled together. the pools only mix if crossplay is enabled and both players have opted in
+func crossplayCompatible(a *ActivePlayer, b *ActivePlayer) bool {
+	if (a.attributes.platform == Platform_PC) == (b.attributes.platform == Platform_PC) {
+		return true
+	}
+	return *crossplayEnabled && a.attributes.crossplay && b.attributes.crossplay
+}
+
+func sameLanguage(a *ActivePlayer, b *ActivePlayer) bool {
+	return a.attributes.language == b.attributes.language
+}
+
+func sameInputDevice(a *ActivePlayer, b *ActivePlayer) bool {
+	return a.attributes.inputDevice == b.attributes.inputDevice
+}
+
+func initializeConstraints(names string) {
+
+	if names == "" {
+		return
+	}
+
+	for _, name := range strings.Split(names, ",") {
+		found := false
+		for _, constraint := range AllMatchConstraints {
+			if constraint.name == name {
+				matchConstraints = append(matchConstraints, constraint)
+				found = true
+			}
+		}
+		if !found {
+			panic(fmt.Sprintf("unknown match constraint: %s", name))
+		}
+	}
+
+	var err error
+	constraintsFile, err = os.Create("constraints.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprintf(constraintsFile, "time,constraint,blocked,players,searchTime\n")
+}
+
+// constraintsAllow checks the candidate against every player already in the group. the mask of constraints that
+// rejected the candidate is returned so the caller can charge the wait to them if the candidate isn't placed anywhere
+func constraintsAllow(candidate *ActivePlayer, group []*ActivePlayer) (bool, uint32) {
+	for i, constraint := range matchConstraints {
+		for _, member := range group {
+			if constraint.relaxTime > 0 && candidate.matchingTime >= constraint.relaxTime && member.matchingTime >= constraint.relaxTime {
+				continue
+			}
+			if !constraint.compatible(candidate, member) {
+				return false, 1 << i
+			}
+		}
+	}
+	return true, 0
+}
+
+// recordBlocked counts a rejection against each constraint in the mask
+func recordBlocked(mask uint32) {
+	for i, constraint := range matchConstraints {
+		if mask&(1<<i) != 0 {
+			constraint.blocked++
+		}
+	}
+}
+
+// recordConstraintStats charges the player's search time to every constraint that held them back
+func recordConstraintStats(player *ActivePlayer) {
+	if constraintsFile == nil {
+		return
+	}
+	if player.blockedBy == 0 {
+		unconstrainedPlayers++
+		unconstrainedSearchTime += player.matchingTime
+	}
+	for i, constraint := range matchConstraints {
+		if player.blockedBy&(1<<i) != 0 {
+			constraint.players++
+			constraint.searchTime += player.matchingTime
+		}
+	}
+	player.blockedBy = 0
+}
+
+// writeConstraintStats compares the average search time of players held back by each constraint against players who never were
+func writeConstraintStats(timeString string) {
+	if constraintsFile == nil {
+		return
+	}
+	averageSearchTime := 0.0
+	if unconstrainedPlayers > 0 {
+		averageSearchTime = unconstrainedSearchTime / float64(unconstrainedPlayers)
+	}
+	fmt.Fprintf(constraintsFile, "%s,none,0,%d,%.2f\n", timeString, unconstrainedPlayers, averageSearchTime)
+	unconstrainedPlayers = 0
+	unconstrainedSearchTime = 0.0
+	for _, constraint := range matchConstraints {
+		averageSearchTime := 0.0
+		if constraint.players > 0 {
+			averageSearchTime = constraint.searchTime / float64(constraint.players)
+		}
+		fmt.Fprintf(constraintsFile, "%s,%s,%d,%d,%.2f\n", timeString, constraint.name, constraint.blocked, constraint.players, averageSearchTime)
+		constraint.blocked = 0
+		constraint.players = 0
+		constraint.searchTime = 0.0
+	}
+}
@@ -0,0 +1,293 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+/*
+	Predicted wait time (ETA).
+
+	For each cell of the world, mode and search state, the estimator keeps a moving average of the number of players
+	searching and the rate they get matched. By Little's law the expected remaining wait for a player in a given state
+	is the number of players searching in that state or a later one, divided by the rate those players get matched.
+	New players are predicted from all search states together.
+
+	Each player's prediction when they start searching is compared with what actually happened, and the calibration
+	report is written to calibration.csv at shutdown.
+*/
+
+const EtaCellSize = 10 // degrees
+const EtaCellsX = 360 / EtaCellSize
+const EtaCellsY = 180 / EtaCellSize
+const EtaWindowSeconds = 300.0
+const EtaNumStates = 3 // ideal, expand, warm body
+
+// predicted wait buckets for the calibration report, in seconds. the last bucket is everything above
+var CalibrationBuckets = []float64{1, 2, 5, 10, 20, 30}
+
+type CalibrationBucket struct {
+	players   int
+	predicted float64
+	actual    float64
+	error     float64
+	unmatched int // players who failed or abandoned, so have no actual wait
+}
+
+var etaMutex sync.RWMutex
+
+var etaSearching []float64 // moving averages, indexed by etaIndex
+
+var etaMatchRate []float64
+
+var etaSearchingNow []int // this second's counts
+
+var etaMatchedNow []int
+
+var calibration []CalibrationBucket
+
+var numNoEstimate int
+
+func initializeEta() {
+	size := EtaCellsX * EtaCellsY * len(gameModes) * EtaNumStates
+	etaSearchingNow = make([]int, size)
+	etaMatchedNow = make([]int, size)
+	calibration = make([]CalibrationBucket, len(CalibrationBuckets)+1)
+	etaMutex.Lock()
+	etaSearching = make([]float64, size)
+	etaMatchRate = make([]float64, size)
+	etaMutex.Unlock()
+}
+
+func etaCell(latitude float64, longitude float64) int {
+	x := int(math.Floor((longitude + 180.0) / EtaCellSize))
+	y := int(math.Floor((latitude + 90.0) / EtaCellSize))
+	x = int(math.Max(0, math.Min(EtaCellsX-1, float64(x))))
+	y = int(math.Max(0, math.Min(EtaCellsY-1, float64(y))))
+	return x + y*EtaCellsX
+}
+
+func etaIndex(cell int, mode int, state int) int {
+	return (cell*len(gameModes)+mode)*EtaNumStates + state
+}
+
+// etaState maps search states onto the estimator's state index. -1 for players that aren't searching
+func etaState(state int) int {
+	switch state {
+	case PlayerState_Ideal:
+		return 0
+	case PlayerState_Expand:
+		return 1
+	case PlayerState_WarmBody:
+		return 2
+	}
+	return -1
+}
+
+// recordEtaSearching counts a player searching this second
+func recordEtaSearching(player *ActivePlayer) {
+	state := etaState(player.state)
+	if state < 0 {
+		return
+	}
+	etaSearchingNow[etaIndex(etaCell(player.latitude, player.longitude), player.modes[0], state)]++
+}
+
+// recordEtaMatched counts a player matched this second, and compares the prediction they got when they started searching with their actual wait
+func recordEtaMatched(player *ActivePlayer) {
+	state := etaState(player.state)
+	if state < 0 {
+		return
+	}
+	etaMatchedNow[etaIndex(etaCell(player.latitude, player.longitude), player.modes[0], state)]++
+	recordCalibration(player, true)
+}
+
+func recordCalibration(player *ActivePlayer, matched bool) {
+	if player.predictedWait < 0.0 {
+		numNoEstimate++
+		return
+	}
+	bucket := &calibration[calibrationBucket(player.predictedWait)]
+	if !matched {
+		bucket.unmatched++
+		return
+	}
+	bucket.players++
+	bucket.predicted += player.predictedWait
+	bucket.actual += player.matchingTime
+	bucket.error += math.Abs(player.matchingTime - player.predictedWait)
+}
+
+func calibrationBucket(predicted float64) int {
+	for i := range CalibrationBuckets {
+		if predicted < CalibrationBuckets[i] {
+			return i
+		}
+	}
+	return len(CalibrationBuckets)
+}
+
+// updateEta folds this second's counts into the moving averages
+func updateEta() {
+	alpha := 1.0 / EtaWindowSeconds
+	etaMutex.Lock()
+	for i := range etaSearching {
+		etaSearching[i] += (float64(etaSearchingNow[i]) - etaSearching[i]) * alpha
+		etaMatchRate[i] += (float64(etaMatchedNow[i]) - etaMatchRate[i]) * alpha
+		etaSearchingNow[i] = 0
+		etaMatchedNow[i] = 0
+	}
+	etaMutex.Unlock()
+}
+
+// predictWait returns the expected remaining wait in seconds for a player in this cell, mode and search state, along
+// with the players searching and the match rate it was computed from. the wait is -1 if nobody has matched here recently.
+// pass PlayerState_New for a player who is about to start searching
+func predictWait(latitude float64, longitude float64, mode int, state int) (float64, float64, float64) {
+	first := 0
+	if state != PlayerState_New {
+		first = etaState(state)
+		if first < 0 {
+			return -1.0, 0.0, 0.0
+		}
+	}
+	cell := etaCell(latitude, longitude)
+	searching := 0.0
+	matchRate := 0.0
+	etaMutex.RLock()
+	for i := first; i < EtaNumStates; i++ {
+		searching += etaSearching[etaIndex(cell, mode, i)]
+		matchRate += etaMatchRate[etaIndex(cell, mode, i)]
+	}
+	etaMutex.RUnlock()
+	if matchRate <= 0.0 {
+		return -1.0, searching, matchRate
+	}
+	return searching / matchRate, searching, matchRate
+}
+
+func writeCalibration() {
+
+	f, err := os.Create("calibration.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	defer f.Close()
+
+	fmt.Fprintf(f, "predicted,players,averagePredicted,averageActual,meanAbsoluteError,unmatched\n")
+
+	for i := range calibration {
+		bucket := &calibration[i]
+		name := ""
+		if i == 0 {
+			name = fmt.Sprintf("<%.0fs", CalibrationBuckets[0])
+		} else if i == len(CalibrationBuckets) {
+			name = fmt.Sprintf("%.0fs+", CalibrationBuckets[i-1])
+		} else {
+			name = fmt.Sprintf("%.0f-%.0fs", CalibrationBuckets[i-1], CalibrationBuckets[i])
+		}
+		averagePredicted := 0.0
+		averageActual := 0.0
+		meanError := 0.0
+		if bucket.players > 0 {
+			averagePredicted = bucket.predicted / float64(bucket.players)
+			averageActual = bucket.actual / float64(bucket.players)
+			meanError = bucket.error / float64(bucket.players)
+		}
+		fmt.Fprintf(f, "%s,%d,%.2f,%.2f,%.2f,%d\n", name, bucket.players, averagePredicted, averageActual, meanError, bucket.unmatched)
+	}
+
+	fmt.Printf("%d players started searching without a wait estimate\n", numNoEstimate)
+}
+
+// etaHandler is a debug endpoint, eg. /eta?latitude=51.5&longitude=-0.1&mode=0&state=new
+func etaHandler(w http.ResponseWriter, r *http.Request) {
+
+	etaMutex.RLock()
+	ready := etaSearching != nil
+	etaMutex.RUnlock()
+	if !ready {
+		http.Error(w, "simulation is still initializing", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+
+	latitude, err1 := strconv.ParseFloat(query.Get("latitude"), 64)
+	longitude, err2 := strconv.ParseFloat(query.Get("longitude"), 64)
+	if err1 != nil || err2 != nil {
+		http.Error(w, "latitude and longitude are required", http.StatusBadRequest)
+		return
+	}
+
+	mode := 0
+	if value := query.Get("mode"); value != "" {
+		mode = -1
+		for i := range gameModes {
+			if gameModes[i].name == value || strconv.Itoa(i) == value {
+				mode = i
+			}
+		}
+		if mode < 0 {
+			http.Error(w, "unknown mode", http.StatusBadRequest)
+			return
+		}
+	}
+
+	state := PlayerState_New
+	switch query.Get("state") {
+	case "", "new":
+	case "ideal":
+		state = PlayerState_Ideal
+	case "expand":
+		state = PlayerState_Expand
+	case "warmbody":
+		state = PlayerState_WarmBody
+	default:
+		http.Error(w, "state must be new, ideal, expand or warmbody", http.StatusBadRequest)
+		return
+	}
+
+	wait, searching, matchRate := predictWait(latitude, longitude, mode, state)
+
+	response := map[string]any{
+		"latitude":  latitude,
+		"longitude": longitude,
+		"mode":      gameModes[mode].name,
+		"state":     query.Get("state"),
+		"searching": searching,
+		"matchRate": matchRate,
+	}
+	if wait >= 0.0 {
+		response["eta"] = wait
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,69 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"math"
+)
+
+// the allowed latency spread between two players grows by this many milliseconds for each second the shorter waiting of the two has searched
+const SpreadRelaxPerSecond = 2.0
+
+var numSpreadMatches int // matches started this second
+
+var totalSpread float64
+
+// maxLatencySpread returns the mode's maximum latency spread, falling back to -spread. zero means no limit
+func maxLatencySpread(mode int) float64 {
+	if gameModes[mode].maxLatencySpread > 0.0 {
+		return gameModes[mode].maxLatencySpread
+	}
+	return *latencySpread
+}
+
+// spreadAllows checks that the candidate's latency to the datacenter is within the allowed spread of every player already in the group
+func spreadAllows(candidate *ActivePlayer, group []*ActivePlayer, datacenterId uint64, mode int) bool {
+	spread := maxLatencySpread(mode)
+	if spread <= 0.0 {
+		return true
+	}
+	latency := matchLatency(candidate, datacenterId)
+	for _, member := range group {
+		allowed := spread + SpreadRelaxPerSecond*math.Min(candidate.matchingTime, member.matchingTime)
+		if math.Abs(latency-matchLatency(member, datacenterId)) > allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// matchSpread returns the minimum and maximum latency of the players in a match
+func matchSpread(match *MatchData) (float64, float64) {
+	minLatency := math.Inf(1)
+	maxLatency := 0.0
+	for _, player := range match.players {
+		minLatency = math.Min(minLatency, player.latency)
+		maxLatency = math.Max(maxLatency, player.latency)
+	}
+	if len(match.players) == 0 {
+		minLatency = 0.0
+	}
+	return minLatency, maxLatency
+}
@@ -0,0 +1,67 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "testing"
+
+// setupTestDatacenters creates datacenters 1 to count with empty queues for the default game mode
+func setupTestDatacenters(count int) {
+	gameModes = make([]GameMode, len(DefaultGameModes))
+	copy(gameModes, DefaultGameModes)
+	datacenters = make(map[uint64]*Datacenter, count)
+	for i := 1; i <= count; i++ {
+		datacenters[uint64(i)] = &Datacenter{playerQueues: make([][]*ActivePlayer, len(gameModes))}
+	}
+}
+
+// testPlayer creates a player in the default mode whose cost to datacenter i+1 is costs[i]. costs must be ascending
+func testPlayer(playerId uint64, costs ...float64) *ActivePlayer {
+	player := &ActivePlayer{playerId: playerId, modes: []int{0}}
+	for i, cost := range costs {
+		player.datacenterCosts = append(player.datacenterCosts, DatacenterCostEntry{datacenterId: uint64(i + 1), cost: cost, latency: cost})
+	}
+	return player
+}
+
+// queueEntries counts how many times the player is in each datacenter queue for the default mode
+func queueEntries(player *ActivePlayer) map[uint64]int {
+	entries := make(map[uint64]int)
+	for datacenterId, datacenter := range datacenters {
+		for _, queued := range datacenter.playerQueues[0] {
+			if queued == player {
+				entries[datacenterId]++
+			}
+		}
+	}
+	return entries
+}
+
+func checkQueueEntries(t *testing.T, player *ActivePlayer, expected ...uint64) {
+	t.Helper()
+	entries := queueEntries(player)
+	if len(entries) != len(expected) {
+		t.Fatalf("player is in %d queues, expected %d: %v", len(entries), len(expected), entries)
+	}
+	for _, datacenterId := range expected {
+		if entries[datacenterId] != 1 {
+			t.Fatalf("player is in the queue for datacenter %d %d times, expected once: %v", datacenterId, entries[datacenterId], entries)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// ProposedMatch is a match a matcher wants to start this tick
+type ProposedMatch struct {
+	mode         int
+	datacenterId uint64
+	players      []*ActivePlayer
+}
+
+// Matcher forms matches from the players searching in the datacenter queues. it must not change player state, except
+// for constraint stats when record is true. the caller starts the matches it returns
+type Matcher interface {
+	FindMatches(record bool) []ProposedMatch
+}
+
+func searching(player *ActivePlayer) bool {
+	return player.state == PlayerState_Ideal || player.state == PlayerState_Expand || player.state == PlayerState_WarmBody
+}
+
+// ---------------------------------------------------------------------------------------------------------------------------
+
+// GreedyMatcher is the original matcher. each datacenter in turn fills matches from its shuffled queue, so a player can
+// be taken by a worse datacenter before a better one gets a turn. with load balancing, the least loaded datacenters
+// first fill matches from players within the balance tolerance of their best datacenter
+type GreedyMatcher struct{}
+
+func (matcher *GreedyMatcher) FindMatches(record bool) []ProposedMatch {
+
+	matches := make([]ProposedMatch, 0, 1024)
+
+	taken := make(map[uint64]bool)
+
+	if *balanceTolerance > 0.0 {
+		for _, datacenterId := range leastLoadedDatacenters() {
+			matches = fillDatacenter(matches, datacenterId, datacenters[datacenterId], taken, false, true)
+		}
+	}
+
+	for datacenterId, datacenter := range datacenters {
+		matches = fillDatacenter(matches, datacenterId, datacenter, taken, record, false)
+	}
+
+	return matches
+}
+
+// fillDatacenter fills matches from the datacenter's queues in queue order. when balanced is true, only players within
+// the balance tolerance of their best datacenter are considered
+func fillDatacenter(matches []ProposedMatch, datacenterId uint64, datacenter *Datacenter, taken map[uint64]bool, record bool, balanced bool) []ProposedMatch {
+
+	for mode := range datacenter.playerQueues {
+
+		// build matches from compatible players. without match constraints every player is compatible, so this fills one match at a time in queue order
+
+		groups := make([][]*ActivePlayer, 0, 16)
+
+		grouped := make(map[uint64]bool) // a player can only be in one group, even if they are in the queue twice
+
+		for _, player := range datacenter.playerQueues[mode] {
+
+			if !searching(player) || taken[player.playerId] || grouped[player.playerId] {
+				continue
+			}
+
+			if balanced && !withinBalanceTolerance(player, datacenterId) {
+				continue
+			}
+
+			placed := false
+			blockedBy := uint32(0)
+
+			for j := range groups {
+
+				compatible, rejectedBy := constraintsAllow(player, groups[j])
+				if !compatible {
+					blockedBy |= rejectedBy
+					continue
+				}
+
+				if !spreadAllows(player, groups[j], datacenterId, mode) {
+					continue
+				}
+
+				groups[j] = append(groups[j], player)
+
+				if len(groups[j]) == gameModes[mode].playersPerMatch {
+
+					matches = append(matches, ProposedMatch{mode: mode, datacenterId: datacenterId, players: groups[j]})
+
+					for _, member := range groups[j] {
+						taken[member.playerId] = true
+					}
+
+					// go to next match
+
+					groups = append(groups[:j], groups[j+1:]...)
+				}
+
+				placed = true
+				break
+			}
+
+			if !placed {
+				if record {
+					recordBlocked(blockedBy)
+					player.blockedBy |= blockedBy
+				}
+				groups = append(groups, []*ActivePlayer{player})
+			}
+
+			grouped[player.playerId] = true
+		}
+	}
+
+	return matches
+}
+
+// ---------------------------------------------------------------------------------------------------------------------------
+
+const Objective_Total = 0 // minimize average cost across matched players
+const Objective_Worst = 1 // minimize the worst cost in each match, then the average
+
+// OptimizedMatcher looks at every datacenter queue at once. it repeatedly starts the cheapest match that can be formed
+// anywhere, where the cheapest match for a datacenter and mode is the lowest cost compatible group from its queue.
+// candidates are kept in a heap and recomputed lazily when one of their players has been taken by a cheaper match.
+// with load balancing, costs include a penalty for how loaded the datacenter is
+type OptimizedMatcher struct {
+	objective int
+}
+
+type matcherQueue struct {
+	datacenterId uint64
+	mode         int
+	players      []*ActivePlayer // searching players sorted by cost to the datacenter, then queue order
+	costs        []float64
+	first        int             // players before this index have all been taken
+	recorded     map[uint64]bool // players whose blocked constraints have been counted. bestMatch runs more than once per queue
+}
+
+type candidateMatch struct {
+	worst   float64
+	average float64
+	queue   *matcherQueue
+	players []*ActivePlayer
+	index   int
+}
+
+type CandidateQueue struct {
+	objective  int
+	candidates []*candidateMatch
+}
+
+func (pq *CandidateQueue) Len() int { return len(pq.candidates) }
+
+func (pq *CandidateQueue) Less(i, j int) bool {
+	a := pq.candidates[i]
+	b := pq.candidates[j]
+	if pq.objective == Objective_Worst && a.worst != b.worst {
+		return a.worst < b.worst
+	}
+	return a.average < b.average
+}
+
+func (pq *CandidateQueue) Swap(i, j int) {
+	pq.candidates[i], pq.candidates[j] = pq.candidates[j], pq.candidates[i]
+	pq.candidates[i].index = i
+	pq.candidates[j].index = j
+}
+
+func (pq *CandidateQueue) Push(x any) {
+	item := x.(*candidateMatch)
+	item.index = len(pq.candidates)
+	pq.candidates = append(pq.candidates, item)
+}
+
+func (pq *CandidateQueue) Pop() any {
+	n := len(pq.candidates)
+	item := pq.candidates[n-1]
+	pq.candidates[n-1] = nil
+	item.index = -1
+	pq.candidates = pq.candidates[:n-1]
+	return item
+}
+
+// bestMatch finds the lowest cost compatible group in the queue among players not yet taken
+func bestMatch(queue *matcherQueue, taken map[uint64]bool, record bool) *candidateMatch {
+
+	playersPerMatch := gameModes[queue.mode].playersPerMatch
+
+	for queue.first < len(queue.players) && taken[queue.players[queue.first].playerId] {
+		queue.first++
+	}
+
+	groups := make([][]int, 0, 16)
+
+	for i := queue.first; i < len(queue.players); i++ {
+
+		player := queue.players[i]
+
+		if taken[player.playerId] {
+			continue
+		}
+
+		placed := false
+		blockedBy := uint32(0)
+
+		for j := range groups {
+
+			group := make([]*ActivePlayer, len(groups[j]))
+			for k, index := range groups[j] {
+				group[k] = queue.players[index]
+			}
+
+			compatible, rejectedBy := constraintsAllow(player, group)
+			if !compatible {
+				blockedBy |= rejectedBy
+				continue
+			}
+
+			if !spreadAllows(player, group, queue.datacenterId, queue.mode) {
+				continue
+			}
+
+			groups[j] = append(groups[j], i)
+
+			if len(groups[j]) == playersPerMatch {
+				candidate := &candidateMatch{queue: queue, players: append(group, player)}
+				total := 0.0
+				for _, index := range groups[j] {
+					total += queue.costs[index]
+					candidate.worst = math.Max(candidate.worst, queue.costs[index])
+				}
+				candidate.average = total / float64(playersPerMatch)
+				return candidate
+			}
+
+			placed = true
+			break
+		}
+
+		if !placed {
+			if record && !queue.recorded[player.playerId] {
+				recordBlocked(blockedBy)
+				player.blockedBy |= blockedBy
+				queue.recorded[player.playerId] = true
+			}
+			groups = append(groups, []int{i})
+		}
+	}
+
+	return nil
+}
+
+func (matcher *OptimizedMatcher) FindMatches(record bool) []ProposedMatch {
+
+	matches := make([]ProposedMatch, 0, 1024)
+
+	taken := make(map[uint64]bool)
+
+	candidates := &CandidateQueue{objective: matcher.objective}
+
+	for datacenterId, datacenter := range datacenters {
+
+		for mode := range datacenter.playerQueues {
+
+			queue := &matcherQueue{datacenterId: datacenterId, mode: mode, recorded: make(map[uint64]bool)}
+
+			seen := make(map[uint64]bool)
+
+			for _, player := range datacenter.playerQueues[mode] {
+				if !searching(player) || seen[player.playerId] {
+					continue
+				}
+				cost, ok := datacenterCost(player, datacenterId)
+				if !ok {
+					continue
+				}
+				seen[player.playerId] = true
+				queue.players = append(queue.players, player)
+				queue.costs = append(queue.costs, balancedCost(datacenterId, cost))
+			}
+
+			if len(queue.players) < gameModes[mode].playersPerMatch {
+				continue
+			}
+
+			// stable, so players of equal cost keep the queue order
+
+			sort.Stable(queue)
+
+			if candidate := bestMatch(queue, taken, record); candidate != nil {
+				candidates.candidates = append(candidates.candidates, candidate)
+			}
+		}
+	}
+
+	heap.Init(candidates)
+
+	for candidates.Len() > 0 {
+
+		candidate := heap.Pop(candidates).(*candidateMatch)
+
+		stale := false
+		for _, player := range candidate.players {
+			if taken[player.playerId] {
+				stale = true
+				break
+			}
+		}
+
+		if !stale {
+			for _, player := range candidate.players {
+				taken[player.playerId] = true
+			}
+			matches = append(matches, ProposedMatch{mode: candidate.queue.mode, datacenterId: candidate.queue.datacenterId, players: candidate.players})
+		}
+
+		// the next best match from this queue can only cost the same or more, so it goes back into the heap to compete
+
+		if next := bestMatch(candidate.queue, taken, record); next != nil {
+			heap.Push(candidates, next)
+		}
+	}
+
+	return matches
+}
+
+func (queue *matcherQueue) Len() int { return len(queue.players) }
+
+func (queue *matcherQueue) Less(i, j int) bool { return queue.costs[i] < queue.costs[j] }
+
+func (queue *matcherQueue) Swap(i, j int) {
+	queue.players[i], queue.players[j] = queue.players[j], queue.players[i]
+	queue.costs[i], queue.costs[j] = queue.costs[j], queue.costs[i]
+}
+
+// ---------------------------------------------------------------------------------------------------------------------------
+
+// MatcherStats compares what a matcher would do with the same searching pool
+type MatcherStats struct {
+	name    string
+	ticks   int
+	elapsed time.Duration
+	matches int
+	players int
+	latency float64
+	worst   float64 // sum over matches of the highest latency in the match
+}
+
+var matcher Matcher
+
+var baselineMatcher Matcher // when set, runs on the same pool every tick without starting matches, for comparison
+
+var matcherStats []*MatcherStats
+
+var matcherFile *os.File
+
+func createMatcher(name string, objective string) Matcher {
+	objectiveValue := Objective_Total
+	switch objective {
+	case "total":
+	case "worst":
+		objectiveValue = Objective_Worst
+	default:
+		panic(fmt.Sprintf("unknown matcher objective: %s", objective))
+	}
+	switch name {
+	case "greedy":
+		return &GreedyMatcher{}
+	case "optimized":
+		return &OptimizedMatcher{objective: objectiveValue}
+	default:
+		panic(fmt.Sprintf("unknown matcher: %s", name))
+	}
+}
+
+func initializeMatcher() {
+
+	matcher = createMatcher(*matcherName, *matcherObjective)
+
+	if *matcherName == "greedy" {
+		return
+	}
+
+	baselineMatcher = &GreedyMatcher{}
+
+	matcherStats = []*MatcherStats{{name: "greedy"}, {name: *matcherName}}
+
+	var err error
+	matcherFile, err = os.Create("matcher.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprintf(matcherFile, "time,matcher,matches,players,latency,worstLatency,ticksPerSecond\n")
+}
+
+func matchLatency(player *ActivePlayer, datacenterId uint64) float64 {
+	for i := range player.datacenterCosts {
+		if player.datacenterCosts[i].datacenterId == datacenterId {
+			return player.datacenterCosts[i].latency
+		}
+	}
+	return 0.0
+}
+
+func runMatcher(stats *MatcherStats, matcher Matcher, record bool) []ProposedMatch {
+	start := time.Now()
+	matches := matcher.FindMatches(record)
+	if stats != nil {
+		stats.ticks++
+		stats.elapsed += time.Since(start)
+		for _, match := range matches {
+			stats.matches++
+			worst := 0.0
+			for _, player := range match.players {
+				latency := matchLatency(player, match.datacenterId)
+				stats.players++
+				stats.latency += latency
+				worst = math.Max(worst, latency)
+			}
+			stats.worst += worst
+		}
+	}
+	return matches
+}
+
+// findMatches runs the baseline matcher on the searching pool for comparison, if there is one, then runs the configured matcher
+func findMatches() []ProposedMatch {
+	if baselineMatcher == nil {
+		return matcher.FindMatches(true)
+	}
+	runMatcher(matcherStats[0], baselineMatcher, false)
+	return runMatcher(matcherStats[1], matcher, true)
+}
+
+func writeMatcherStats(timeString string) {
+	if matcherFile == nil {
+		return
+	}
+	for _, stats := range matcherStats {
+		latency := 0.0
+		worst := 0.0
+		ticksPerSecond := 0.0
+		if stats.players > 0 {
+			latency = stats.latency / float64(stats.players)
+		}
+		if stats.matches > 0 {
+			worst = stats.worst / float64(stats.matches)
+		}
+		if stats.elapsed > 0 {
+			ticksPerSecond = float64(stats.ticks) / stats.elapsed.Seconds()
+		}
+		fmt.Fprintf(matcherFile, "%s,%s,%d,%d,%.2f,%.2f,%.0f\n", timeString, stats.name, stats.matches, stats.players, latency, worst, ticksPerSecond)
+		*stats = MatcherStats{name: stats.name}
+	}
+}
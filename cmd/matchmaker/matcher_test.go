@@ -0,0 +1,82 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "testing"
+
+// setupDuplicateQueue puts one more player than a match needs in datacenter 1's queue, with the first player queued twice
+func setupDuplicateQueue() []*ActivePlayer {
+
+	setupTestDatacenters(1)
+
+	players := make([]*ActivePlayer, gameModes[0].playersPerMatch)
+	for i := range players {
+		players[i] = testPlayer(uint64(i+1), 20)
+		players[i].state = PlayerState_Ideal
+	}
+
+	queue := append([]*ActivePlayer{players[0]}, players...)
+	datacenters[1].playerQueues[0] = queue
+
+	return players
+}
+
+func checkNoDuplicatePlayers(t *testing.T, matches []ProposedMatch, expectedMatches int) {
+	t.Helper()
+	if len(matches) != expectedMatches {
+		t.Fatalf("found %d matches, expected %d", len(matches), expectedMatches)
+	}
+	for _, match := range matches {
+		if len(match.players) != gameModes[match.mode].playersPerMatch {
+			t.Fatalf("match has %d players, expected %d", len(match.players), gameModes[match.mode].playersPerMatch)
+		}
+		seen := make(map[uint64]bool)
+		for _, player := range match.players {
+			if seen[player.playerId] {
+				t.Fatalf("player %d is in the match twice", player.playerId)
+			}
+			seen[player.playerId] = true
+		}
+	}
+}
+
+func TestGreedyMatcherDuplicateQueueEntry(t *testing.T) {
+
+	setupDuplicateQueue()
+
+	checkNoDuplicatePlayers(t, (&GreedyMatcher{}).FindMatches(false), 1)
+
+	// without enough distinct players there is no match
+
+	datacenters[1].playerQueues[0] = datacenters[1].playerQueues[0][:gameModes[0].playersPerMatch]
+
+	checkNoDuplicatePlayers(t, (&GreedyMatcher{}).FindMatches(false), 0)
+}
+
+func TestOptimizedMatcherDuplicateQueueEntry(t *testing.T) {
+
+	setupDuplicateQueue()
+
+	checkNoDuplicatePlayers(t, (&OptimizedMatcher{objective: Objective_Total}).FindMatches(false), 1)
+
+	datacenters[1].playerQueues[0] = datacenters[1].playerQueues[0][:gameModes[0].playersPerMatch]
+
+	checkNoDuplicatePlayers(t, (&OptimizedMatcher{objective: Objective_Total}).FindMatches(false), 0)
+}
@@ -59,7 +59,16 @@ const SpeedOfLightFactor = 2
 const IdealCostThreshold = 50
 const ExpandCostThreshold = 100
 
-const SampleDays = 5 // the number of days worth of samples contained in players.csv
+const CellFlag_Estimated = 0 // no samples. latency is estimated from distance
+const CellFlag_Measured = 1
+const CellFlag_Filled = 2 // no samples. latency was filled in from neighbouring cells by transform
+
+const LowConfidenceSamples = 10 // measured cells with fewer samples than this are low confidence
+const LowConfidenceSafetyMargin = 5
+const FilledSafetyMargin = 10
+const EstimatedSafetyMargin = 0 // estimates are already conservative via SpeedOfLightFactor
+
+const SampleDays = 5 // the number of days worth of samples contained in players.csv, unless it has a #days header
 
 const LatencyMapWidth = 360
 const LatencyMapHeight = 180
@@ -83,10 +92,21 @@ type NewPlayerData struct {
 
 var newPlayerData [][]NewPlayerData
 
+var arrivalSampleDays float64
+
 func percentChance(threshold int) bool {
 	return randomInt(0, 100) <= threshold
 }
 
+// randomRound rounds down or up at random, weighted by the fractional part, so scaled arrival counts are correct on average
+func randomRound(value float64) int {
+	whole := math.Floor(value)
+	if rand.Float64() < value-whole {
+		whole++
+	}
+	return int(whole)
+}
+
 func randomInt(min int, max int) int {
 	difference := max - min
 	value := rand.Intn(difference + 1)
@@ -118,33 +138,52 @@ func kilometersToRTT(kilometers float64) float64 {
 	return kilometers / 299792.458 * 1000.0 * 2.0 * (3.0 / 2.0) // speed of light is 2/3rds in fiber optic cables
 }
 
-func datacenterRTT(datacenter *Datacenter, playerLatitude float64, playerLongitude float64) float64 {
-	lat := playerLatitude
-	long := playerLatitude
-	if lat < MinLatitude {
-		lat = MinLatitude
-	}
-	if lat > MaxLatitude {
-		lat = MaxLatitude
-	}
-	if long < 0 {
-		long = MaxLongitude + long
-	}
-	long = math.Mod(long, LatencyMapWidth)
-	x := int(math.Floor(long)) + MaxLongitude
-	y := MaxLatitude - int(math.Floor(lat))
-	if x >= LatencyMapWidth {
+func getLatencyMapIndex(latitude float64, longitude float64) int {
+	x := int(math.Floor(longitude)) - MinLongitude
+	y := MaxLatitude - int(math.Floor(latitude))
+	if x < 0 {
+		x = 0
+	} else if x >= LatencyMapWidth {
 		x = LatencyMapWidth - 1
 	}
-	if y >= LatencyMapHeight {
+	if y < 0 {
+		y = 0
+	} else if y >= LatencyMapHeight {
 		y = LatencyMapHeight - 1
 	}
-	index := x + y*LatencyMapWidth
-	if datacenter.latencyMap != nil && datacenter.latencyMap[index] > 0.0 {
-		return float64(datacenter.latencyMap[index])
+	return x + y*LatencyMapWidth
+}
+
+func datacenterRTT(datacenter *Datacenter, bucket int, playerLatitude float64, playerLongitude float64) (float64, int, float32) {
+	index := getLatencyMapIndex(playerLatitude, playerLongitude)
+	latencyMap := datacenter.latencyMaps[bucket]
+	if latencyMap != nil && latencyMap.latency[index] > 0.0 {
+		confidence := CellFlag_Measured
+		if latencyMap.flags != nil {
+			confidence = int(latencyMap.flags[index])
+		}
+		samples := float32(0.0)
+		if latencyMap.samples != nil {
+			samples = latencyMap.samples[index]
+		}
+		return float64(latencyMap.latency[index]), confidence, samples
 	} else {
 		kilometers := haversineDistance(playerLatitude, playerLongitude, datacenter.latitude, datacenter.longitude)
-		return kilometersToRTT(kilometers) * SpeedOfLightFactor
+		return kilometersToRTT(kilometers) * SpeedOfLightFactor, CellFlag_Estimated, 0.0
+	}
+}
+
+func safetyMargin(confidence int, samples float32, hasSamples bool) float64 {
+	switch confidence {
+	case CellFlag_Measured:
+		if hasSamples && samples < LowConfidenceSamples {
+			return LowConfidenceSafetyMargin
+		}
+		return 0.0
+	case CellFlag_Filled:
+		return FilledSafetyMargin
+	default:
+		return EstimatedSafetyMargin
 	}
 }
 
@@ -164,15 +203,22 @@ func getPlayerMapIndex(player *ActivePlayer) int {
 	return ix + iy*MapWidth
 }
 
+type LatencyMap struct {
+	latency             []float32
+	samples             []float32 // optional. nil if the map was written without sample counts
+	flags               []byte    // optional. nil if the map was written without cell flags
+}
+
 type Datacenter struct {
 	name                string
 	latitude            float64
 	longitude           float64
 	playerCount         int
-	playerQueue         []*ActivePlayer
+	playerQueues        [][]*ActivePlayer // one queue per game mode
 	averageLatency      float64
 	averageSearchTime   float64
-	latencyMap          []float32
+	latencyMaps         []*LatencyMap // one per time of day bucket. nil if there is no map for that bucket
+	load                DatacenterLoad
 }
 
 var datacenters map[uint64]*Datacenter
@@ -183,10 +229,16 @@ const PlayerState_Expand = 2
 const PlayerState_WarmBody = 3
 const PlayerState_Playing = 4
 const PlayerState_BetweenMatches = 5
+const PlayerState_Abandoned = 6
+const PlayerState_Left = 7 // left the game part way through a match
+const PlayerState_Failed = 8 // ran out of search stages without a match
 
 type DatacenterCostEntry struct {
 	datacenterId uint64
-	cost         float64
+	cost         float64 // latency plus safety margin for low confidence cells. used for thresholds and ordering
+	latency      float64
+	confidence   int
+	samples      float32
 }
 
 const DatacenterLookupWidth = MaxLongitude - MinLongitude + 1
@@ -194,6 +246,8 @@ const DatacenterLookupHeight = MaxLatitude - MinLatitude + 1
 
 var datacenterLookup [DatacenterLookupWidth*DatacenterLookupHeight][]DatacenterCostEntry
 
+var datacenterLookupBucket int
+
 func getDatacenterLookupIndex(latitude int, longitude int) int {
 	x := latitude - MinLatitude
 	y := longitude - MinLongitude
@@ -210,6 +264,102 @@ func getDatacenterLookupIndex(latitude int, longitude int) int {
 	return x + y * DatacenterLookupWidth
 }
 
+func numTimeBuckets() int {
+	if *timeBuckets > 0 {
+		return *timeBuckets
+	}
+	return 1
+}
+
+func getTimeBucket(seconds uint64) int {
+	return int((seconds % SecondsPerDay) * uint64(numTimeBuckets()) / SecondsPerDay)
+}
+
+func loadLatencyMap(filename string) *LatencyMap {
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	if len(data) != LatencyMapBytes {
+		panic(fmt.Sprintf("latency map %s is invalid size (%d bytes)", filename, len(data)))
+	}
+	fmt.Printf("loaded %s\n", filename)
+	index := 0
+	floatArray := make([]float32, LatencyMapSize)
+	for i := 0; i < LatencyMapSize; i++ {
+		integerValue := binary.LittleEndian.Uint32(data[index : index+4])
+		floatArray[i] = math.Float32frombits(integerValue)
+		index += 4
+	}
+
+	latencyMap := &LatencyMap{latency: floatArray}
+
+	// optional per-cell sample counts and flags written by average and transform
+
+	basename := strings.TrimSuffix(filename, ".bin")
+
+	data, err = os.ReadFile(basename + "_samples.bin")
+	if err == nil {
+		if len(data) != LatencyMapBytes {
+			panic(fmt.Sprintf("sample counts %s_samples.bin is invalid size (%d bytes)", basename, len(data)))
+		}
+		index = 0
+		samplesArray := make([]float32, LatencyMapSize)
+		for i := 0; i < LatencyMapSize; i++ {
+			integerValue := binary.LittleEndian.Uint32(data[index : index+4])
+			samplesArray[i] = math.Float32frombits(integerValue)
+			index += 4
+		}
+		latencyMap.samples = samplesArray
+	}
+
+	data, err = os.ReadFile(basename + "_flags.bin")
+	if err == nil {
+		if len(data) != LatencyMapSize {
+			panic(fmt.Sprintf("cell flags %s_flags.bin is invalid size (%d bytes)", basename, len(data)))
+		}
+		latencyMap.flags = data
+	}
+
+	return latencyMap
+}
+
+func buildDatacenterLookup(bucket int) {
+
+	fmt.Printf("generating datacenter lookup (time bucket %d)...\n", bucket)
+
+	for latitude := MinLatitude; latitude <= MaxLatitude; latitude++ {
+
+		for longitude := MinLongitude; longitude <= MaxLongitude; longitude++ {
+
+			datacenterCosts := make([]DatacenterCostEntry, len(datacenters))
+
+			index := 0
+			for k, v := range datacenters {
+				milliseconds, confidence, samples := datacenterRTT(v, bucket, float64(latitude), float64(longitude))
+				hasSamples := v.latencyMaps[bucket] != nil && v.latencyMaps[bucket].samples != nil
+				datacenterCosts[index].datacenterId = k
+				datacenterCosts[index].cost = milliseconds + safetyMargin(confidence, samples, hasSamples)
+				datacenterCosts[index].latency = milliseconds
+				datacenterCosts[index].confidence = confidence
+				datacenterCosts[index].samples = samples
+				index++
+			}
+
+			sort.SliceStable(datacenterCosts[:], func(i, j int) bool {
+				return datacenterCosts[i].cost < datacenterCosts[j].cost
+			})
+
+			lookupIndex := getDatacenterLookupIndex(latitude, longitude)
+
+			datacenterLookup[lookupIndex] = datacenterCosts
+		}
+	}
+
+	datacenterLookupBucket = bucket
+}
+
 type ActivePlayer struct {
 	playerId          uint64
 	state             int
@@ -220,8 +370,139 @@ type ActivePlayer struct {
 	matchingTime      float64
 	datacenterId      uint64
 	latency           float64
+	spike             int  // 1 + index into spikes if the player arrived inside a spike region during the spike, 0 otherwise
+	injected          bool // true if the spike added this player on top of the dataset
+	sessionStart      uint64
+	sessionLength     float64
+	matchesPlayed     int
+	persistent        *PersistentPlayer // nil unless the persistent population model is enabled
+	attributes        PlayerAttributes
+	datacenterRules   DatacenterRules
+	modes             []int // game modes the player queues for. the first is their primary mode
+	mode              int   // game mode of the player's current or last match
+	match             *MatchData // the player's current or last match
+	thresholds        *RegionThresholds // nil unless adaptive thresholds are enabled
+	blockedBy         uint32 // mask of match constraints that kept this player out of a match during the current search
+	predictedWait     float64 // wait time estimate when the player started searching, -1 if there was none
+	stage             int // index into searchStages while searching
+	queued            map[QueueKey]bool // datacenter queues joined during the current search
+}
+
+// ---------------------------------------------------------------------------------------------------------------------------
+
+const SpikeGroup_Organic = 0 // players from the dataset that arrived inside the spike region during the spike
+const SpikeGroup_Injected = 1 // players the spike added on top of the dataset
+
+// spikeReportDelay is long enough for every player from the spike to have matched or failed
+func spikeReportDelay() uint64 {
+	return uint64(searchScheduleSeconds() + 2)
+}
+
+type SpikeStats struct {
+	arrivals   int
+	matched    int
+	failures   int
+	abandoned  int
+	searchTime float64
+	latency    float64
+}
+
+type Spike struct {
+	name         string
+	start        uint64
+	duration     uint64
+	minLatitude  float64
+	maxLatitude  float64
+	minLongitude float64
+	maxLongitude float64
+	multiplier   float64 // oversample dataset arrivals inside the region by this factor
+	players      float64 // synthetic arrivals spread evenly across the window, uniformly inside the region
+	stats        [2]SpikeStats
+}
+
+var spikes []*Spike
+
+var spikesFile *os.File
+
+func (spike *Spike) active(seconds uint64) bool {
+	return seconds >= spike.start && seconds < spike.start+spike.duration
+}
+
+func (spike *Spike) contains(latitude float64, longitude float64) bool {
+	return latitude >= spike.minLatitude && latitude <= spike.maxLatitude && longitude >= spike.minLongitude && longitude <= spike.maxLongitude
+}
+
+func loadSpikes(filename string) []*Spike {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	result := make([]*Spike, 0)
+
+	for scanner.Scan() {
+		values := strings.Split(scanner.Text(), ",")
+		if len(values) != 9 {
+			continue
+		}
+		start, err := time.Parse("2006-01-02 15:04:05", values[1])
+		if err != nil {
+			continue
+		}
+		duration, err := strconv.Atoi(values[2])
+		if err != nil || duration <= 0 {
+			continue
+		}
+		spike := Spike{name: values[0], start: uint64(start.Sub(secondsToTime(0)) / time.Second), duration: uint64(duration)}
+		spike.minLatitude, _ = strconv.ParseFloat(values[3], 64)
+		spike.maxLatitude, _ = strconv.ParseFloat(values[4], 64)
+		spike.minLongitude, _ = strconv.ParseFloat(values[5], 64)
+		spike.maxLongitude, _ = strconv.ParseFloat(values[6], 64)
+		spike.multiplier, _ = strconv.ParseFloat(values[7], 64)
+		spike.players, _ = strconv.ParseFloat(values[8], 64)
+		result = append(result, &spike)
+		fmt.Printf("loaded spike %s\n", spike.name)
+	}
+
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	return result
 }
 
+func spikeStats(player *ActivePlayer) *SpikeStats {
+	if player.injected {
+		return &spikes[player.spike-1].stats[SpikeGroup_Injected]
+	}
+	return &spikes[player.spike-1].stats[SpikeGroup_Organic]
+}
+
+func writeSpikeStats(spike *Spike) {
+	for group := range spike.stats {
+		stats := &spike.stats[group]
+		groupName := "organic"
+		if group == SpikeGroup_Injected {
+			groupName = "injected"
+		}
+		averageSearchTime := 0.0
+		averageLatency := 0.0
+		if stats.matched > 0 {
+			averageSearchTime = stats.searchTime / float64(stats.matched)
+			averageLatency = stats.latency / float64(stats.matched)
+		}
+		fmt.Fprintf(spikesFile, "%s,%s,%d,%d,%d,%d,%.1f,%.1f\n", spike.name, groupName, stats.arrivals, stats.matched, stats.failures, stats.abandoned, averageSearchTime, averageLatency)
+		fmt.Printf("spike %s (%s): %d arrivals %d matched %d failed %d abandoned %.1fs average search time %.1fms average latency\n", spike.name, groupName, stats.arrivals, stats.matched, stats.failures, stats.abandoned, averageSearchTime, averageLatency)
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------------
+
 var activePlayers map[uint64]*ActivePlayer
 
 var inGamePlayers map[uint64]*ActivePlayer
@@ -234,15 +515,9 @@ var statsFile *os.File
 
 // ---------------------------------------------------------------------------------------------------------------------------
 
-func initialize() {
-
-	fmt.Printf("initializing...\n")
-
-	rand.Seed(time.Now().UnixNano())
-
-	// load the players.csv file and parse it
+func loadPlayersCSV(filename string) {
 
-	f, err := os.Open("data/players.csv")
+	f, err := os.Open(filename)
 	if err != nil {
 		panic(err)
 	}
@@ -253,8 +528,19 @@ func initialize() {
 
 	newPlayerData = make([][]NewPlayerData, SecondsPerDay)
 
+	arrivalSampleDays = SampleDays
+
 	for scanner.Scan() {
 		values := strings.Split(scanner.Text(), ",")
+		if len(values) == 2 && values[0] == "#days" {
+			// written by the generate command when it writes other than SampleDays days of samples
+			days, err := strconv.Atoi(values[1])
+			if err != nil || days <= 0 {
+				panic(fmt.Sprintf("invalid #days header in %s: %s. days must be at least 1", filename, values[1]))
+			}
+			arrivalSampleDays = float64(days)
+			continue
+		}
 		if len(values) != 3 {
 			continue
 		}
@@ -273,19 +559,42 @@ func initialize() {
 	if err := scanner.Err(); err != nil {
 		panic(err)
 	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------------
+
+func initialize() {
+
+	fmt.Printf("initializing...\n")
+
+	rand.Seed(time.Now().UnixNano())
+
+	// load player arrivals. the binary format is memory mapped, the csv is parsed into memory
+
+	if strings.HasSuffix(*playersFilename, ".bin") {
+		loadArrivals(*playersFilename)
+	} else {
+		loadPlayersCSV(*playersFilename)
+	}
+
+	// load game modes. datacenters have one queue per mode
+
+	initializeGameModes(*gameModesName)
+
+	initializeSearchStages(*searchStagesFilename)
 
 	// initialize datacenters for the simulation
 
 	datacenters = make(map[uint64]*Datacenter)
 
-	f, err = os.Open("data/datacenters.csv")
+	f, err := os.Open("data/datacenters.csv")
 	if err != nil {
 		panic(err)
 	}
 
 	defer f.Close()
 
-	scanner = bufio.NewScanner(f)
+	scanner := bufio.NewScanner(f)
 
 	for scanner.Scan() {
 		values := strings.Split(scanner.Text(), ",")
@@ -300,59 +609,35 @@ func initialize() {
 	}
 
 	for _, v := range datacenters {
-		v.playerQueue = make([]*ActivePlayer, 0, 100 * 1024)
+		v.playerQueues = make([][]*ActivePlayer, len(gameModes))
+		for mode := range v.playerQueues {
+			v.playerQueues[mode] = make([]*ActivePlayer, 0, 100 * 1024)
+		}
 	}
 
-	// load latency maps for each datacenter
+	// load latency maps for each datacenter. time of day variants fall back to the static map when missing
 
 	for _, v := range datacenters {
-		datacenterName := v.name
-		filename := fmt.Sprintf("data/latency_%s.bin", datacenterName)
-		data, err := os.ReadFile(filename)
-		if err != nil {
-			continue
+		basename := fmt.Sprintf("data/latency_%s", v.name)
+		if *latencyPercentile != "" {
+			basename = fmt.Sprintf("data/latency_%s_%s", v.name, *latencyPercentile)
 		}
-		if len(data) != LatencyMapBytes {
-			panic(fmt.Sprintf("latency map %s is invalid size (%d bytes)", filename, len(data)))
-		}
-		fmt.Printf("loaded %s\n", filename)
-		index := 0
-		floatArray := make([]float32, LatencyMapSize)
-		for i := 0; i < LatencyMapSize; i++ {
-			integerValue := binary.LittleEndian.Uint32(data[index : index+4])
-			floatArray[i] = math.Float32frombits(integerValue)
-			index += 4
+		staticMap := loadLatencyMap(basename + ".bin")
+		v.latencyMaps = make([]*LatencyMap, numTimeBuckets())
+		for bucket := range v.latencyMaps {
+			v.latencyMaps[bucket] = staticMap
+			if *timeBuckets > 0 {
+				bucketMap := loadLatencyMap(fmt.Sprintf("%s_b%02d.bin", basename, bucket))
+				if bucketMap != nil {
+					v.latencyMaps[bucket] = bucketMap
+				}
+			}
 		}
-		v.latencyMap = floatArray
 	}
 
 	// create lookup for datacenters in latency order by lat, long
 
-	fmt.Printf("generating datacenter lookup...\n")
-
-	for latitude := MinLatitude; latitude <= MaxLatitude; latitude++ {
-
-		for longitude := MinLongitude; longitude <= MaxLongitude; longitude++ {
-
-			datacenterCosts := make([]DatacenterCostEntry, len(datacenters))
-
-			index := 0
-			for k, v := range datacenters {
-				milliseconds := datacenterRTT(v, float64(latitude), float64(longitude))
-				datacenterCosts[index].datacenterId = k
-				datacenterCosts[index].cost = milliseconds
-				index++
-			}
-
-			sort.SliceStable(datacenterCosts[:], func(i, j int) bool {
-				return datacenterCosts[i].cost < datacenterCosts[j].cost
-			})
-
-			lookupIndex := getDatacenterLookupIndex(latitude, longitude)
-
-			datacenterLookup[lookupIndex] = datacenterCosts
-		}
-	}
+	buildDatacenterLookup(getTimeBucket(0))
 
 	// create active players hash (empty)
 
@@ -371,11 +656,60 @@ func initialize() {
 		panic(err)
 	}
 
+	fmt.Fprintf(matchesFile, "time,datacenter,mode,players,latency,minLatency,maxLatency,spread,searchTime,warmBodies,bots")
+	if qualityEnabled() {
+		fmt.Fprintf(matchesFile, ",quality")
+	}
+	fmt.Fprintf(matchesFile, "\n")
+
 	statsFile, err = os.Create("stats.csv")
 	if err != nil {
 		panic(err)
 	}
 
+	fmt.Fprintf(statsFile, "time,players,searchTime,latency,matchedMeasured,matchedFilled,matchedEstimated,failures,abandoned,spread\n")
+
+	sessionModel = createSessionModel(*sessionModelName)
+
+	abandonmentCurve = loadAbandonmentCurve(*abandonmentCurveName)
+
+	if *persistentPopulation {
+		initializePopulation()
+	}
+
+	initializeConstraints(*matchConstraintNames)
+
+	initializeDatacenterRules()
+
+	initializeBackfill()
+
+	initializeMatcher()
+
+	initializeAdaptiveThresholds(*adaptiveThresholds)
+
+	initializeEta()
+
+	initializeWarmBodies()
+
+	initializeQueueOrder(*queueOrderName)
+
+	initializeBots()
+
+	initializeQuality(*qualityWeightsValue)
+
+	initializeLoadBalancing()
+
+	// load demand spike scenarios
+
+	if *spikesFilename != "" {
+		spikes = loadSpikes(*spikesFilename)
+		spikesFile, err = os.Create("spikes.csv")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Fprintf(spikesFile, "spike,group,arrivals,matched,failures,abandoned,searchTime,latency\n")
+	}
+
 	// initialize the priority queues
 
 	heap.Init(&matchQueue)
@@ -386,7 +720,15 @@ func initialize() {
 
 type MatchData struct {
 	priority uint64
-	players [PlayersPerMatch]*ActivePlayer
+	start uint64
+	mode int
+	datacenterId uint64
+	players []*ActivePlayer
+	openSlots []uint64 // when each open slot opened, oldest first
+	shortSince uint64  // when the match last went short-handed. only valid while there are open slots
+	shortSeconds uint64
+	warmBodies int // players who joined in the warm body stage
+	bots int
 	index int
 }
 
@@ -423,23 +765,217 @@ func (pq *MatchPriorityQueue) Pop() any {
 
 var matchQueue MatchPriorityQueue
 
-var betweenMatchesQueue MatchPriorityQueue
-
 var lastFinishedMatch *MatchData
 
-var lastBetweenMatch *MatchData
+// -----------------------------------------------------------------------------------------------------
+
+type PlayerData struct {
+	priority uint64
+	player *ActivePlayer
+	index int
+}
+
+type PlayerPriorityQueue []*PlayerData
+
+func (pq PlayerPriorityQueue) Len() int { return len(pq) }
+
+func (pq PlayerPriorityQueue) Less(i, j int) bool {
+	return pq[i].priority < pq[j].priority
+}
+
+func (pq PlayerPriorityQueue) Swap(i, j int) {
+	pq[i], pq[j] = pq[j], pq[i]
+	pq[i].index = i
+	pq[j].index = j
+}
+
+func (pq *PlayerPriorityQueue) Push(x any) {
+	n := len(*pq)
+	item := x.(*PlayerData)
+	item.index = n
+	*pq = append(*pq, item)
+}
+
+func (pq *PlayerPriorityQueue) Pop() any {
+	old := *pq
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil  // avoid memory leak
+	item.index = -1 // for safety
+	*pq = old[0 : n-1]
+	return item
+}
+
+var betweenMatchesQueue PlayerPriorityQueue
+
+var lastBetweenMatch *PlayerData
+
+var countData [MapSize]float64
+
+var numMatchedByConfidence [3]int // players matched this second by the confidence of their latency map cell
 
 // ----------------------------------------------------------------------------------------------------
 
+// startMatch moves the players into a match on this datacenter. the match pops off the match queue when it's finished
+func startMatch(seconds uint64, mode int, datacenterId uint64, datacenter *Datacenter, matchPlayers []*ActivePlayer, bots int) {
+
+	matchData := MatchData{}
+	matchData.priority = uint64(seconds + gameModes[mode].matchLengthSeconds)
+	matchData.start = seconds
+	matchData.mode = mode
+	matchData.datacenterId = datacenterId
+	matchData.players = make([]*ActivePlayer, 0, len(matchPlayers))
+	matchData.bots = bots
+
+	for j := range matchPlayers {
+		joinMatch(seconds, &matchData, datacenter, matchPlayers[j])
+	}
+
+	// record the match and the latency spread between its players
+
+	minLatency, maxLatency := matchSpread(&matchData)
+
+	numSpreadMatches++
+	totalSpread += maxLatency - minLatency
+
+	averageLatency := 0.0
+	averageSearchTime := 0.0
+	for _, player := range matchData.players {
+		averageLatency += player.latency
+		averageSearchTime += player.matchingTime
+	}
+	averageLatency /= float64(len(matchData.players))
+	averageSearchTime /= float64(len(matchData.players))
+
+	fmt.Fprintf(matchesFile, "%d,%s,%s,%d,%.1f,%.1f,%.1f,%.1f,%.1f,%d,%d", seconds, datacenter.name, gameModes[mode].name, len(matchData.players), averageLatency, minLatency, maxLatency, maxLatency-minLatency, averageSearchTime, matchData.warmBodies, matchData.bots)
+
+	if qualityEnabled() {
+		quality := matchQuality(averageLatency, minLatency, maxLatency, averageSearchTime)
+		recordMatchQuality(mode, quality)
+		fmt.Fprintf(matchesFile, ",%.1f", quality)
+	}
+
+	fmt.Fprintf(matchesFile, "\n")
+
+	recordWarmBodyMatch(&matchData, averageLatency)
+
+	recordBotMatch(&matchData)
+
+	recordDatacenterLoad(&matchData)
+
+	// insert the match into the match queue. it will pop off when it's finished
+
+	heap.Push(&matchQueue, &matchData)
+}
+
+// joinMatch moves a searching player into a match, either when the match starts or when they backfill an open slot
+func joinMatch(seconds uint64, match *MatchData, datacenter *Datacenter, player *ActivePlayer) {
+
+	// update stats
+
+	datacenter.playerCount++
+	datacenter.load.playing++
+	latency := 0.0
+	for k := range player.datacenterCosts {
+		if player.datacenterCosts[k].datacenterId == match.datacenterId {
+			latency = player.datacenterCosts[k].latency
+			numMatchedByConfidence[player.datacenterCosts[k].confidence]++
+			break
+		}
+	}
+	datacenter.averageLatency += (latency - datacenter.averageLatency) * 0.05
+	datacenter.averageSearchTime += (player.matchingTime - datacenter.averageSearchTime) * 0.01
+
+	if player.thresholds != nil {
+		player.thresholds.matched++
+		player.thresholds.searchTime += player.matchingTime
+		if player.state == PlayerState_WarmBody {
+			player.thresholds.warmBodies++
+		}
+	}
+
+	if player.state == PlayerState_WarmBody {
+		match.warmBodies++
+		recordWarmBodyMatched(latency)
+	}
+
+	recordEtaMatched(player)
+
+	if match.bots > 0 {
+		searchStages[player.stage].botFilled++
+	} else {
+		searchStages[player.stage].matched++
+	}
+
+	player.state = PlayerState_Playing
+	player.datacenterId = match.datacenterId
+	player.latency = latency
+	player.mode = match.mode
+	player.match = match
+	player.counter = 0
+
+	gameModes[match.mode].matched++
+	gameModes[match.mode].searchTime += player.matchingTime
+	recordSearchTime(player.matchingTime)
+	gameModes[match.mode].latency += latency
+
+	if player.persistent != nil {
+		recordPersistentMatch(player, latency)
+	}
+
+	recordConstraintStats(player)
+
+	if player.spike != 0 {
+		stats := spikeStats(player)
+		stats.matched++
+		stats.searchTime += player.matchingTime
+		stats.latency += latency
+		player.spike = 0
+	}
+
+	index := getPlayerMapIndex(player)
+
+	countData[index]++
+
+	// move the player from the active player set into the match
+
+	delete(activePlayers, player.playerId)
+
+	match.players = append(match.players, player)
+
+	inGamePlayers[player.playerId] = player
+
+	scheduleLeave(seconds, match, player)
+}
+
+var stopSimulation = make(chan struct{})
+
+var simulationStopped = make(chan struct{})
+
 func runSimulation() {
 
-	var countData [MapSize]float64
+	defer close(simulationStopped)
 
 	var seconds uint64
 	var playerId uint64
 
 	for {
 
+		// stop between ticks on shutdown, so end of run reports see a consistent state
+
+		select {
+		case <-stopSimulation:
+			return
+		default:
+		}
+
+		// switch latency maps when the simulated time of day moves into a new bucket
+
+		bucket := getTimeBucket(seconds)
+		if bucket != datacenterLookupBucket {
+			buildDatacenterLookup(bucket)
+		}
+
 		// add new players to the simulation
 
 		var wg sync.WaitGroup
@@ -448,41 +984,101 @@ func runSimulation() {
 
 		newPlayers := make(map[uint64]*ActivePlayer, 100000)
 
+		spikeArrivals := make([][2]int, len(spikes))
+
 		go func() {
 
-			index := seconds % SecondsPerDay
+			addPlayer := func(latitude float64, longitude float64, spike int, injected bool) {
+
+				activePlayer := ActivePlayer{}
+
+				activePlayer.playerId = playerId
+				activePlayer.latitude = latitude
+				activePlayer.longitude = longitude
+				activePlayer.spike = spike
+				activePlayer.injected = injected
+				activePlayer.attributes = randomAttributes(latitude, longitude)
+				activePlayer.modes = randomGameModes()
+				activePlayer.sessionStart = seconds
+				activePlayer.sessionLength = sessionModel.SessionLength(&activePlayer, seconds)
+
+				lookupIndex := getDatacenterLookupIndex(int(math.Floor(latitude)), int(math.Floor(longitude)))
+
+				activePlayer.datacenterCosts = datacenterLookup[lookupIndex]
+
+				activePlayer.datacenterRules = randomDatacenterRules(activePlayer.datacenterCosts)
 
-			length := len(newPlayerData[index])
+				newPlayers[playerId] = &activePlayer
+
+				if spike != 0 {
+					if injected {
+						spikeArrivals[spike-1][SpikeGroup_Injected]++
+					} else {
+						spikeArrivals[spike-1][SpikeGroup_Organic]++
+					}
+				}
 
-			if length == 0 {
-				wg.Done()
-				return
+				playerId++
 			}
 
-			offset := rand.Intn(length)
+			arrivals := getNewPlayerData(seconds)
 
-			count := length / SampleDays
+			length := len(arrivals)
 
-			for j := 0; j < count; j++ {
+			// dataset arrivals, scaled by the population multiplier. arrivals inside an active spike region are tagged so the spike can be compared against them
 
-				player_index := ( j + offset ) % length
+			regionArrivals := make([][]NewPlayerData, len(spikes))
 
-				activePlayer := ActivePlayer{}
+			if length > 0 {
 
-				activePlayer.playerId = playerId
-				activePlayer.latitude = newPlayerData[index][player_index].latitude
-				activePlayer.longitude = newPlayerData[index][player_index].longitude
+				offset := rand.Intn(length)
 
-				latitude := int(math.Floor(newPlayerData[index][player_index].latitude))
-				longitude := int(math.Floor(newPlayerData[index][player_index].longitude))
+				count := randomRound(float64(length) / arrivalSampleDays * *populationScale)
 
-				lookupIndex := getDatacenterLookupIndex(latitude, longitude)
+				for j := 0; j < count; j++ {
 
-				activePlayer.datacenterCosts = datacenterLookup[lookupIndex]
+					player_index := ( j + offset ) % length
 
-				newPlayers[playerId] = &activePlayer
+					playerData := arrivals[player_index]
 
-				playerId++
+					spike := 0
+					for k := range spikes {
+						if spikes[k].active(seconds) && spikes[k].contains(playerData.latitude, playerData.longitude) {
+							regionArrivals[k] = append(regionArrivals[k], playerData)
+							if spike == 0 {
+								spike = k + 1
+							}
+						}
+					}
+
+					addPlayer(playerData.latitude, playerData.longitude, spike, false)
+				}
+			}
+
+			// spike arrivals on top of the dataset
+
+			for k := range spikes {
+
+				if !spikes[k].active(seconds) {
+					continue
+				}
+
+				if spikes[k].multiplier > 1.0 && len(regionArrivals[k]) > 0 {
+					count := randomRound(float64(len(regionArrivals[k])) * (spikes[k].multiplier - 1.0))
+					for j := 0; j < count; j++ {
+						playerData := regionArrivals[k][rand.Intn(len(regionArrivals[k]))]
+						addPlayer(playerData.latitude, playerData.longitude, k+1, true)
+					}
+				}
+
+				if spikes[k].players > 0.0 {
+					count := randomRound(spikes[k].players / float64(spikes[k].duration))
+					for j := 0; j < count; j++ {
+						latitude := spikes[k].minLatitude + rand.Float64()*(spikes[k].maxLatitude-spikes[k].minLatitude)
+						longitude := spikes[k].minLongitude + rand.Float64()*(spikes[k].maxLongitude-spikes[k].minLongitude)
+						addPlayer(latitude, longitude, k+1, true)
+					}
+				}
 			}
 
 			wg.Done()
@@ -500,43 +1096,47 @@ func runSimulation() {
 				break
 			}
 
+			finishMatch(seconds, lastFinishedMatch)
+
 		    for i := range lastFinishedMatch.players {
 				player := lastFinishedMatch.players[i]
                 index := getPlayerMapIndex(player)
                 countData[index]--
                 delete(inGamePlayers, player.playerId)
 				betweenMatchPlayers[player.playerId] = player
+				player.matchesPlayed++
+				heap.Push(&betweenMatchesQueue, &PlayerData{priority: seconds + sessionModel.ThinkTime(player), player: player})
 		    }
 
-			lastFinishedMatch.priority += BetweenMatchSeconds
-
-			heap.Push(&betweenMatchesQueue, lastFinishedMatch)
-
 		    lastFinishedMatch = nil
 		}
 
+		// players leaving part way through a match open up slots for backfill
+
+		processLeavers(seconds)
+
 		// handle between matches state transitioning back to searching for next match
 
 		for {
 
 			if lastBetweenMatch == nil && len(betweenMatchesQueue) > 0 {
-				lastBetweenMatch = heap.Pop(&betweenMatchesQueue).(*MatchData)
+				lastBetweenMatch = heap.Pop(&betweenMatchesQueue).(*PlayerData)
 			}
 
 			if lastBetweenMatch == nil || lastBetweenMatch.priority > seconds {
 				break
 			}
 
-		    for i := range lastBetweenMatch.players {
-				player := lastBetweenMatch.players[i]
-				delete(betweenMatchPlayers, player.playerId)
-				if percentChance(PlayAgainPercent) {
-					player.state = PlayerState_New
-					player.counter = 0
-					player.datacenterId = 0
-					activePlayers[player.playerId] = player
-				}
-		    }
+			player := lastBetweenMatch.player
+			delete(betweenMatchPlayers, player.playerId)
+			if sessionModel.PlayAgain(player, seconds) {
+				player.state = PlayerState_New
+				player.counter = 0
+				player.datacenterId = 0
+				activePlayers[player.playerId] = player
+			} else {
+				endPersistentSession(player, SessionEnd_Left)
+			}
 
 		    lastBetweenMatch = nil
 		}
@@ -548,6 +1148,12 @@ func runSimulation() {
 		numExpand := 0
 		numWarmBody := 0
 		numFailures := 0
+		numAbandoned := 0
+
+		numMatchedByConfidence = [3]int{}
+
+		numSpreadMatches = 0
+		totalSpread = 0.0
 
 		warmBodies := make(map[uint64]*ActivePlayer, 10000)
 
@@ -557,92 +1163,74 @@ func runSimulation() {
 
 				numNew++
 
-				cost := activePlayers[i].datacenterCosts[0].cost
-
-				activePlayers[i].counter = 0
 				activePlayers[i].matchingTime = 0.0
 
-				if cost <= IdealCostThreshold {
-
-					activePlayers[i].state = PlayerState_Ideal
+				activePlayers[i].predictedWait, _, _ = predictWait(activePlayers[i].latitude, activePlayers[i].longitude, activePlayers[i].modes[0], PlayerState_New)
 
-					for j := range activePlayers[i].datacenterCosts {
-						datacenterId := activePlayers[i].datacenterCosts[j].datacenterId
-						datacenterCost := activePlayers[i].datacenterCosts[j].cost
-						if datacenterCost <= IdealCostThreshold {
-							datacenters[datacenterId].playerQueue = append(datacenters[datacenterId].playerQueue, activePlayers[i])
-						} else {
-							break
-						}
-					}
+				startSearch(activePlayers[i])
 
-				} else if cost <= ExpandCostThreshold {
-
-					activePlayers[i].state = PlayerState_Expand
-
-					for j := range activePlayers[i].datacenterCosts {
-						datacenterId := activePlayers[i].datacenterCosts[j].datacenterId
-						datacenterCost := activePlayers[i].datacenterCosts[j].cost
-						if datacenterCost <= ExpandCostThreshold {
-							datacenters[datacenterId].playerQueue = append(datacenters[datacenterId].playerQueue, activePlayers[i])
-						} else if datacenterCost > ExpandCostThreshold {
-							break
-						}
-					}
-
-				} else {
+			}
 
-					activePlayers[i].state = PlayerState_WarmBody
+			// searching players may give up and leave the game before matchmaking gives up on them
 
+			if abandonmentCurve != nil && rand.Float64() < abandonmentHazard(activePlayers[i].matchingTime) {
+				numAbandoned++
+				gameModes[activePlayers[i].modes[0]].abandoned++
+				recordCalibration(activePlayers[i], false)
+				if activePlayers[i].spike != 0 {
+					spikeStats(activePlayers[i]).abandoned++
+					activePlayers[i].spike = 0
 				}
+				activePlayers[i].state = PlayerState_Abandoned
+				endPersistentSession(activePlayers[i], SessionEnd_Abandoned)
+				delete(activePlayers, i)
+				continue
+			}
 
+			if activePlayers[i].thresholds != nil {
+				activePlayers[i].thresholds.searching++
 			}
 
-			if activePlayers[i].state == PlayerState_Ideal {
+			recordEtaSearching(activePlayers[i])
 
-				numIdeal++
-
-				activePlayers[i].counter++
-				activePlayers[i].matchingTime += 1.0
-
-				if activePlayers[i].counter >= IdealTime {
-					activePlayers[i].state = PlayerState_Expand
-					activePlayers[i].counter = 0
-					for j := range activePlayers[i].datacenterCosts {
-						datacenterId := activePlayers[i].datacenterCosts[j].datacenterId
-						datacenterCost := activePlayers[i].datacenterCosts[j].cost
-						if datacenterCost > IdealCostThreshold && datacenterCost <= ExpandCostThreshold {
-							datacenters[datacenterId].playerQueue = append(datacenters[datacenterId].playerQueue, activePlayers[i])
-						}
-					}
-				}
+			// step the player through the search schedule
 
+			if activePlayers[i].state == PlayerState_Ideal {
+				numIdeal++
 			} else if activePlayers[i].state == PlayerState_Expand {
-
 				numExpand++
-
-				activePlayers[i].counter++
-				activePlayers[i].matchingTime += 1.0
-
-				if activePlayers[i].counter >= ExpandTime {
-					activePlayers[i].state = PlayerState_WarmBody
-					activePlayers[i].counter = 0
-				}
-
 			} else if activePlayers[i].state == PlayerState_WarmBody {
-
 				numWarmBody++
+				warmBodies[i] = activePlayers[i]
+			}
 
-				activePlayers[i].counter++
-				activePlayers[i].matchingTime += 1.0
+			activePlayers[i].counter++
+			activePlayers[i].matchingTime += 1.0
 
-				warmBodies[i] = activePlayers[i]
+			if stageEnded(activePlayers[i]) {
+
+				// players whose stage allows bots, or whose search times out with bot fill, get a match with bots
 
-				if activePlayers[i].counter > ExpandTime {
+				if botFillAtStageEnd(activePlayers[i]) {
+					botFillPlayers = append(botFillPlayers, activePlayers[i])
+					delete(warmBodies, i)
+					continue
+				}
+
+				if !lastStage(activePlayers[i]) {
+					enterStage(activePlayers[i], activePlayers[i].stage+1)
+				} else {
 					numFailures++
+					failSearch(activePlayers[i])
+					delete(warmBodies, i)
 					delete(activePlayers, activePlayers[i].playerId)
+					continue
 				}
+			}
 
+			if waitedForBots(activePlayers[i]) {
+				botFillPlayers = append(botFillPlayers, activePlayers[i])
+				delete(warmBodies, i)
 			}
 		}
 
@@ -661,100 +1249,64 @@ func runSimulation() {
 
 		fmt.Printf("%s: %10d players %4ds average search time %5dms average latency\n", time.Format("2006-01-02 15:04:05"), len(inGamePlayers) + len(betweenMatchPlayers), int(math.Ceil(averageSearchTime)), int(math.Ceil(averageLatency)))
 
-		// fmt.Printf("%s: %10d playing %8d between matches %5d new %5d ideal %5d expand %4d warmbody %4d fail %4ds search time %4dms latency\n", time.Format("2006-01-02 15:04:05"), len(inGamePlayers), len(betweenMatchPlayers), numNew, numIdeal, numExpand, numWarmBody, numFailures, int(math.Ceil(averageSearchTime)), int(math.Ceil(averageLatency)))
+		// fmt.Printf("%s: %10d playing %8d between matches %5d new %5d ideal %5d expand %4d warmbody %4d fail %4d abandon %4ds search time %4dms latency\n", time.Format("2006-01-02 15:04:05"), len(inGamePlayers), len(betweenMatchPlayers), numNew, numIdeal, numExpand, numWarmBody, numFailures, numAbandoned, int(math.Ceil(averageSearchTime)), int(math.Ceil(averageLatency)))
 
-		// iterate across all datacenter queues
+		// order datacenter queues for backfill and matching
 
-		for datacenterId, datacenter := range datacenters {
+		for _, datacenter := range datacenters {
+			for _, queue := range datacenter.playerQueues {
+				orderQueue(queue)
+			}
+		}
 
-			playerCount := 0
-			var matchPlayers [PlayersPerMatch]*ActivePlayer
+		// backfill open slots in matches already in progress before forming new matches
 
-			for i := range datacenter.playerQueue {
+		if *backfillEnabled {
+			backfill(seconds)
+		}
 
-				if datacenter.playerQueue[i].state == PlayerState_Ideal || datacenter.playerQueue[i].state == PlayerState_Expand || datacenter.playerQueue[i].state == PlayerState_WarmBody {
-					matchPlayers[playerCount] = datacenter.playerQueue[i]
-					playerCount++
-				} else {
-					continue
-				}
+		// sample datacenter load for load aware datacenter selection and load stats
 
-				if playerCount == PlayersPerMatch {
-					
-					// update stats
-
-					for j := 0; j < PlayersPerMatch; j++ {
-						datacenter.playerCount++
-						latency := 0.0
-						for k := range matchPlayers[j].datacenterCosts {
-							if matchPlayers[j].datacenterCosts[k].datacenterId == datacenterId {
-								latency = matchPlayers[j].datacenterCosts[k].cost
-								break
-							}
-						}
-						datacenter.averageLatency += (latency - datacenter.averageLatency) * 0.05
-						datacenter.averageSearchTime += (matchPlayers[j].matchingTime - datacenter.averageSearchTime) * 0.01
-						matchPlayers[j].state = PlayerState_Playing
-						matchPlayers[j].datacenterId = datacenterId
-						matchPlayers[j].latency = latency
-						matchPlayers[j].counter = 0
+		updateDatacenterLoad()
 
-						index := getPlayerMapIndex(matchPlayers[j])
+		// complete lobbies with bots for players who have waited too long
 
-						countData[index]++
+		runBotFill(seconds)
 
-						// fmt.Fprintf(matchesFile, "%d,%.1f,%.1f,%s,%.1f,%.1f\n", seconds, matchPlayers[j].latitude, matchPlayers[j].longitude, datacenter.name, latency, matchPlayers[j].matchingTime)
-					}
+		// form new matches across all datacenter queues
 
-					// remove players from active player set
+		for _, match := range findMatches() {
+			startMatch(seconds, match.mode, match.datacenterId, datacenters[match.datacenterId], match.players, 0)
+		}
 
-					for j := 0; j < PlayersPerMatch; j++ {
-						delete(activePlayers, matchPlayers[j].playerId)
-					}
+		for _, datacenter := range datacenters {
 
-					// insert the match into the match queue. it will pop off when it's finished
+			for mode, queue := range datacenter.playerQueues {
 
-					matchData := MatchData{}
-					matchData.priority = uint64(seconds + MatchLengthSeconds)
-					copy(matchData.players[:], matchPlayers[:])
-					heap.Push(&matchQueue, &matchData)
-					for j := range matchPlayers {
-						inGamePlayers[matchPlayers[j].playerId] = matchPlayers[j]
-					}
-	
-					// go to next match
+				newPlayerQueue := make([]*ActivePlayer, 0, 10*1024)
 
-					playerCount = 0
+				for i := range queue {
+					if queue[i].state == PlayerState_Ideal || queue[i].state == PlayerState_Expand {
+						newPlayerQueue = append(newPlayerQueue, queue[i])
+					}
 				}
 
+				datacenter.playerQueues[mode] = newPlayerQueue
 			}
-
-			newPlayerQueue := make([]*ActivePlayer, 0, 10*1024)
-
-			for i := range datacenter.playerQueue {
-				if datacenter.playerQueue[i].state == PlayerState_Ideal || datacenter.playerQueue[i].state == PlayerState_Expand {
-					newPlayerQueue = append(newPlayerQueue, datacenter.playerQueue[i])
-				}
-			}
-
-			datacenter.playerQueue = newPlayerQueue
 		}
 
-		// feed warm bodies back into datacenter queues to fill matches
+		// write stats for this second
 
-		for _, warmBody := range warmBodies {
-			for _, datacenter := range datacenters {
-				datacenter.playerQueue = append(datacenter.playerQueue, warmBody)
-			}
+		averageSpread := 0.0
+		if numSpreadMatches > 0 {
+			averageSpread = totalSpread / float64(numSpreadMatches)
 		}
 
-		// shuffle datacenter queues
+		fmt.Fprintf(statsFile, "%s,%d,%.1f,%.1f,%d,%d,%d,%d,%d,%.1f\n", time.Format("2006-01-02 15:04:05"), len(inGamePlayers) + len(betweenMatchPlayers), averageSearchTime, averageLatency, numMatchedByConfidence[CellFlag_Measured], numMatchedByConfidence[CellFlag_Filled], numMatchedByConfidence[CellFlag_Estimated], numFailures, numAbandoned, averageSpread)
 
-		for _, datacenter := range datacenters {
-			rand.Shuffle(len(datacenter.playerQueue), func(i, j int) {
-			    datacenter.playerQueue[i], datacenter.playerQueue[j] = datacenter.playerQueue[j], datacenter.playerQueue[i]
-			})
-		}
+		// feed warm bodies back into datacenter queues to fill matches
+
+		feedWarmBodies(warmBodies)
 
 		// update map data
 
@@ -774,6 +1326,52 @@ func runSimulation() {
 
 		for k,v := range newPlayers {
 			activePlayers[k] = v
+			if *persistentPopulation {
+				assignPersistentPlayer(v, int(seconds / SecondsPerDay))
+			}
+			if datacenterRulesEnabled {
+				applyDatacenterRules(v)
+			}
+			assignThresholdRegion(v)
+		}
+
+		// update spike stats and report spikes once all of their players have matched or failed
+
+		for k := range spikes {
+			spikes[k].stats[SpikeGroup_Organic].arrivals += spikeArrivals[k][SpikeGroup_Organic]
+			spikes[k].stats[SpikeGroup_Injected].arrivals += spikeArrivals[k][SpikeGroup_Injected]
+			if seconds == spikes[k].start {
+				fmt.Printf("spike %s started\n", spikes[k].name)
+			}
+			if seconds == spikes[k].start+spikes[k].duration+spikeReportDelay() {
+				writeSpikeStats(spikes[k])
+			}
+		}
+
+		// report day over day retention at the end of each simulated day
+
+		if *persistentPopulation && (seconds+1) % SecondsPerDay == 0 {
+			updateRetention(int(seconds / SecondsPerDay))
+		}
+
+		// report per game mode stats every minute
+
+		if (seconds+1) % 60 == 0 {
+			writeGameModeStats(time.Format("2006-01-02 15:04:05"))
+		}
+
+		// tune thresholds per region toward the target search time
+
+		updateAdaptiveThresholds(seconds, time.Format("2006-01-02 15:04:05"))
+
+		// update wait time estimates from this second's searching players and matches
+
+		updateEta()
+
+		// write hourly reports
+
+		if (seconds+1) % 3600 == 0 {
+			writeHourlyReports(time.Format("2006-01-02 15:04:05"))
 		}
 
 		// advance time
@@ -782,13 +1380,122 @@ func runSimulation() {
 	}
 }
 
+// writeHourlyReports writes a row for the hour to each hourly report that is enabled
+func writeHourlyReports(timeString string) {
+	writeMatcherStats(timeString)
+	writeBackfillStats(timeString)
+	writeSearchTimeStats(timeString)
+	writeLoadStats(timeString)
+	writeQualityStats(timeString)
+	writeBotStats(timeString)
+	writeWarmBodyStats(timeString)
+	writeConstraintStats(timeString)
+}
+
 func shutdown() {
+	close(stopSimulation)
+	<-simulationStopped
 	matchesFile.Close()
 	statsFile.Close()
+	if spikesFile != nil {
+		spikesFile.Close()
+	}
+	if retentionFile != nil {
+		retentionFile.Close()
+	}
+	if constraintsFile != nil {
+		constraintsFile.Close()
+	}
+	if modesFile != nil {
+		modesFile.Close()
+	}
+	if backfillFile != nil {
+		backfillFile.Close()
+	}
+	if matcherFile != nil {
+		matcherFile.Close()
+	}
+	if warmBodyFile != nil {
+		warmBodyFile.Close()
+	}
+	if searchTimeFile != nil {
+		searchTimeFile.Close()
+	}
+	if qualityFile != nil {
+		qualityFile.Close()
+	}
+	if loadFile != nil {
+		loadFile.Close()
+	}
+	if botsFile != nil {
+		botsFile.Close()
+	}
+	writeThresholdSchedule()
+	writeCalibration()
+	printDatacenterRuleStats()
+	printSearchStageStats()
 }
 
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 
+var playersFilename = flag.String("players", "data/players.csv", "player arrivals file, eg. one written by the generate command")
+
+var sessionModelName = flag.String("session", "flat", "session model: flat (fixed time between matches and chance to play again) or realistic")
+
+var abandonmentCurveName = flag.String("abandon", "off", "queue abandonment hazard curve: off, default, or a csv of searchSeconds,hazardPerSecond")
+
+var persistentPopulation = flag.Bool("population", false, "draw arrivals from a persistent player base and report day over day retention to retention.csv")
+
+var populationScale = flag.Float64("scale", 1.0, "global population multiplier applied to player arrivals")
+
+var spikesFilename = flag.String("spikes", "", "demand spike scenarios csv of name,start,seconds,minLatitude,maxLatitude,minLongitude,maxLongitude,multiplier,players")
+
+var latencyPercentile = flag.String("percentile", "", "match on percentile latency maps, eg. p90 loads data/latency_<city>_p90.bin")
+
+var gameModesName = flag.String("modes", "", "game modes: empty for a single mode, playlist for built-in duel, squad and arena modes, or a csv of name,playersPerMatch,matchSeconds,idealThreshold,expandThreshold,popularity")
+
+var regionLocksFilename = flag.String("regionlocks", "", "region locks csv of name,minLatitude,maxLatitude,minLongitude,maxLongitude,region[,region...]. players inside the box only play in those datacenter regions")
+
+var regionSettings = flag.Bool("regionsettings", false, "simulate players who pick a region or deny datacenters in settings")
+
+var leavePercent = flag.Float64("leave", 0.0, "percent chance a player leaves part way through a match. backfill stats are written to backfill.csv")
+
+var backfillEnabled = flag.Bool("backfill", false, "backfill open slots left by mid-match leavers from players searching on the same datacenter")
+
+var latencySpread = flag.Float64("spread", 0.0, "maximum latency difference in milliseconds between players in a match, relaxed over search time. zero for no limit. modes can set their own")
+
+var adaptiveThresholds = flag.String("adaptive", "off", "adaptive thresholds per region: off, thresholds, all (thresholds and search stage times), or a threshold_schedule.csv to replay")
+
+var targetSearchTime = flag.Float64("targetsearch", 10.0, "target search time in seconds for adaptive thresholds")
+
+var matcherName = flag.String("matcher", "greedy", "matcher: greedy (each datacenter fills matches from its shuffled queue in turn) or optimized (cheapest matches across all datacenters first, compared against greedy in matcher.csv)")
+
+var matcherObjective = flag.String("objective", "total", "optimized matcher objective: total (average latency) or worst (worst latency in each match)")
+
+var matchConstraintNames = flag.String("constraints", "", "comma separated match constraints: crossplay, language, input. per constraint wait time cost is written to constraints.csv")
+
+var crossplayEnabled = flag.Bool("crossplay", true, "allow pc and console players who opted in to crossplay to match together")
+
+var warmBodyCeiling = flag.Float64("warmceiling", 0.0, "maximum latency in milliseconds for warm body fill. zero for no limit")
+
+var warmBodyNearest = flag.Int("warmnearest", 0, "only place warm bodies in their N nearest datacenters with players searching in the mode. zero places them in every datacenter")
+
+var warmBodyShort = flag.Bool("warmshort", false, "only place warm bodies where a match is one player short, when there are any such datacenters")
+
+var queueOrderName = flag.String("queue", "", "datacenter queue order: shuffle (the default), fifo (longest waiting first), aging (seconds searched weighted by search state, highest first) or priority (warm bodies, then expand, then ideal). search time tail is written to searchtime.csv")
+
+var botFill = flag.Bool("bots", false, "complete a match with bots for players whose search times out, instead of failing them. bot ratio per region is written to bots.csv")
+
+var botWaitSeconds = flag.Float64("botwait", 0.0, "also bot fill players who have searched this many seconds. zero to only bot fill when the search times out")
+
+var qualityWeightsValue = flag.String("quality", "", "match quality weights as comma separated name=weight pairs for latency, worst, spread and wait, eg. latency=1,worst=1,spread=1,wait=1. empty to disable. the score is added to matches.csv and its distribution is written to quality.csv")
+
+var balanceTolerance = flag.Float64("balance", 0.0, "steer matches toward the least loaded datacenter among those within this many milliseconds of a player's best. zero to disable. load per datacenter is written to load.csv")
+
+var searchStagesFilename = flag.String("stages", "", "search schedule csv of name,threshold,duration[,rule...]. empty for the default ideal, expand and warm body stages")
+
+var timeBuckets = flag.Int("buckets", 0, "number of time of day latency map buckets, eg. 24 loads data/latency_<city>_b00.bin to data/latency_<city>_b23.bin")
+
 func main() {
     
     flag.Parse()
@@ -808,6 +1515,7 @@ func main() {
 		router.HandleFunc("/", serveFile("index.html")).Methods("GET")
 		router.HandleFunc("/map.js", serveFile("map.js")).Methods("GET")
 		router.HandleFunc("/styles.css", serveFile("styles.css")).Methods("GET")
+		router.HandleFunc("/eta", etaHandler).Methods("GET")
 		fmt.Printf("starting web server\n")
 		c := cors.New(cors.Options{
 			AllowedOrigins:   []string{"*"},
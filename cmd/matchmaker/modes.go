@@ -0,0 +1,207 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+	Game modes (playlists).
+
+	Each datacenter has an independent queue per game mode. Players pick a primary mode by popularity, and may also
+	queue for a second mode at the same time, taking whichever match comes first. The primary mode's thresholds decide
+	the player's search state, and each mode's own thresholds decide which of its datacenter queues the player joins.
+*/
+
+const MultiModePercent = 20 // chance a player also queues for a second mode
+
+type GameMode struct {
+	name                string
+	playersPerMatch     int
+	matchLengthSeconds  uint64
+	idealCostThreshold  float64
+	expandCostThreshold float64
+	popularity          float64 // relative share of players who pick this mode as their primary mode
+	maxLatencySpread    float64 // maximum latency difference between players in a match. zero uses -spread
+	matched             int
+	searchTime          float64
+	latency             float64
+	failures            int
+	abandoned           int
+}
+
+// the default is a single mode that matches the original simulation
+var DefaultGameModes = []GameMode{
+	{name: "default", playersPerMatch: PlayersPerMatch, matchLengthSeconds: MatchLengthSeconds, idealCostThreshold: IdealCostThreshold, expandCostThreshold: ExpandCostThreshold, popularity: 1.0},
+}
+
+var PlaylistGameModes = []GameMode{
+	{name: "duel", playersPerMatch: 2, matchLengthSeconds: 180, idealCostThreshold: 40, expandCostThreshold: 80, popularity: 0.25, maxLatencySpread: 25},
+	{name: "squad", playersPerMatch: 4, matchLengthSeconds: 300, idealCostThreshold: 50, expandCostThreshold: 100, popularity: 0.55},
+	{name: "arena", playersPerMatch: 16, matchLengthSeconds: 600, idealCostThreshold: 60, expandCostThreshold: 120, popularity: 0.20},
+}
+
+var gameModes []GameMode
+
+var modesFile *os.File
+
+// loadGameModes accepts "" for the single default mode, "playlist" for the built-in duel, squad and arena modes, or a
+// csv of name,playersPerMatch,matchSeconds,idealThreshold,expandThreshold,popularity with an optional maxLatencySpread
+func loadGameModes(name string) []GameMode {
+
+	if name == "" {
+		return DefaultGameModes
+	}
+
+	if name == "playlist" {
+		return PlaylistGameModes
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		panic(err)
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	modes := make([]GameMode, 0)
+
+	for scanner.Scan() {
+		values := strings.Split(scanner.Text(), ",")
+		if len(values) != 6 && len(values) != 7 {
+			continue
+		}
+		playersPerMatch, err1 := strconv.Atoi(values[1])
+		matchSeconds, err2 := strconv.Atoi(values[2])
+		idealThreshold, err3 := strconv.ParseFloat(values[3], 64)
+		expandThreshold, err4 := strconv.ParseFloat(values[4], 64)
+		popularity, err5 := strconv.ParseFloat(values[5], 64)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || err5 != nil || playersPerMatch < 2 {
+			continue
+		}
+		mode := GameMode{name: values[0], playersPerMatch: playersPerMatch, matchLengthSeconds: uint64(matchSeconds), idealCostThreshold: idealThreshold, expandCostThreshold: expandThreshold, popularity: popularity}
+		if len(values) == 7 {
+			mode.maxLatencySpread, _ = strconv.ParseFloat(values[6], 64)
+		}
+		modes = append(modes, mode)
+	}
+
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	if len(modes) == 0 {
+		panic(fmt.Sprintf("game modes file %s has no modes", name))
+	}
+
+	fmt.Printf("loaded %d game modes from %s\n", len(modes), name)
+
+	return modes
+}
+
+func initializeGameModes(name string) {
+
+	gameModes = loadGameModes(name)
+
+	if name == "" {
+		return
+	}
+
+	var err error
+	modesFile, err = os.Create("modes.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprintf(modesFile, "time,mode,searching,matched,searchTime,latency,failures,abandoned\n")
+}
+
+func randomGameMode(exclude int) int {
+	total := 0.0
+	for i := range gameModes {
+		if i != exclude {
+			total += gameModes[i].popularity
+		}
+	}
+	value := rand.Float64() * total
+	for i := range gameModes {
+		if i == exclude {
+			continue
+		}
+		if value < gameModes[i].popularity {
+			return i
+		}
+		value -= gameModes[i].popularity
+	}
+	for i := len(gameModes) - 1; i >= 0; i-- {
+		if i != exclude {
+			return i
+		}
+	}
+	return 0
+}
+
+// randomGameModes returns the modes a new player queues for. the first entry is the player's primary mode
+func randomGameModes() []int {
+	primary := randomGameMode(-1)
+	if len(gameModes) > 1 && percentChance(MultiModePercent) {
+		return []int{primary, randomGameMode(primary)}
+	}
+	return []int{primary}
+}
+
+// writeGameModeStats reports players searching in each mode right now, and the players matched, failed and abandoned since the last report
+func writeGameModeStats(timeString string) {
+
+	if modesFile == nil {
+		return
+	}
+
+	searching := make([]int, len(gameModes))
+	for _, player := range activePlayers {
+		for _, mode := range player.modes {
+			searching[mode]++
+		}
+	}
+
+	for i := range gameModes {
+		mode := &gameModes[i]
+		averageSearchTime := 0.0
+		averageLatency := 0.0
+		if mode.matched > 0 {
+			averageSearchTime = mode.searchTime / float64(mode.matched)
+			averageLatency = mode.latency / float64(mode.matched)
+		}
+		fmt.Fprintf(modesFile, "%s,%s,%d,%d,%.2f,%.1f,%d,%d\n", timeString, mode.name, searching[i], mode.matched, averageSearchTime, averageLatency, mode.failures, mode.abandoned)
+		mode.matched = 0
+		mode.searchTime = 0.0
+		mode.latency = 0.0
+		mode.failures = 0
+		mode.abandoned = 0
+	}
+}
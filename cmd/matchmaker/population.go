@@ -0,0 +1,244 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+)
+
+/*
+	Optional persistent population model.
+
+	Each arrival from the dataset is matched to an offline player from the persistent player base in the same lookup
+	cell, or creates a new player if there is nobody to draw from. When a session ends the player may churn, with a
+	chance that goes up with bad latency and failed searches. Players that don't churn go back into the pool for
+	their cell and can be drawn again by a later arrival.
+*/
+
+const ReturningPercent = 80 // chance an arrival is a returning player, when the cell has offline players to draw from
+
+const ChurnBasePercent = 2.0
+const ChurnLatencyThreshold = 50.0 // ms. session average latency above this increases the chance to churn
+const ChurnPercentPerMillisecond = 0.1
+const ChurnFailedSearchPercent = 10.0 // added when a session ends because matchmaking failed or the player gave up
+
+const SessionEnd_Left = 0
+const SessionEnd_Failed = 1
+const SessionEnd_Abandoned = 2
+
+// retention is broken down by the average latency a player saw on the day. the last bucket is for players who never got a match
+var RetentionLatencyBuckets = []float64{30, 50, 80, 120, math.Inf(1)}
+
+var RetentionBucketNames = []string{"<30ms", "30-50ms", "50-80ms", "80-120ms", "120ms+", "unmatched"}
+
+type PersistentPlayer struct {
+	id                uint64
+	latitude          float64
+	longitude         float64
+	lookupIndex       int
+	attributes        PlayerAttributes
+	modes             []int
+	datacenterRules   DatacenterRules
+	firstDay          int
+	lastDay           int
+	matchesPlayed     int
+	sessions          int
+	totalLatency      float64
+	totalWaitTime     float64
+	dayMatches        int
+	dayLatency        float64
+	sessionMatches    int
+	sessionLatency    float64
+	cohortDay         int
+	cohortBucket      int
+	churned           bool
+}
+
+var persistentPlayers []*PersistentPlayer
+
+var persistentPool map[int][]*PersistentPlayer // offline, non-churned players by lookup cell
+
+var populationNewPlayers int
+
+var populationReturningPlayers int
+
+var populationChurned int
+
+var retentionFile *os.File
+
+func initializePopulation() {
+
+	persistentPlayers = make([]*PersistentPlayer, 0, 1000000)
+
+	persistentPool = make(map[int][]*PersistentPlayer)
+
+	var err error
+	retentionFile, err = os.Create("retention.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprintf(retentionFile, "day,latency,active,returned,retention\n")
+}
+
+// assignPersistentPlayer draws an offline player from the pool for this arrival's cell, or creates a new one
+func assignPersistentPlayer(player *ActivePlayer, day int) {
+
+	lookupIndex := getDatacenterLookupIndex(int(math.Floor(player.latitude)), int(math.Floor(player.longitude)))
+
+	var persistent *PersistentPlayer
+
+	pool := persistentPool[lookupIndex]
+	if len(pool) > 0 && percentChance(ReturningPercent) {
+		i := rand.Intn(len(pool))
+		persistent = pool[i]
+		pool[i] = pool[len(pool)-1]
+		persistentPool[lookupIndex] = pool[:len(pool)-1]
+		player.latitude = persistent.latitude
+		player.longitude = persistent.longitude
+		player.attributes = persistent.attributes
+		player.modes = persistent.modes
+		player.datacenterRules = persistent.datacenterRules
+		populationReturningPlayers++
+	} else {
+		persistent = &PersistentPlayer{id: uint64(len(persistentPlayers)), latitude: player.latitude, longitude: player.longitude, lookupIndex: lookupIndex, attributes: player.attributes, modes: player.modes, datacenterRules: player.datacenterRules, firstDay: day, lastDay: -1, cohortDay: -1}
+		persistentPlayers = append(persistentPlayers, persistent)
+		populationNewPlayers++
+	}
+
+	if persistent.lastDay != day {
+		persistent.lastDay = day
+		persistent.dayMatches = 0
+		persistent.dayLatency = 0.0
+	}
+
+	persistent.sessions++
+	persistent.sessionMatches = 0
+	persistent.sessionLatency = 0.0
+
+	player.persistent = persistent
+}
+
+func recordPersistentMatch(player *ActivePlayer, latency float64) {
+	persistent := player.persistent
+	persistent.matchesPlayed++
+	persistent.totalLatency += latency
+	persistent.totalWaitTime += player.matchingTime
+	persistent.dayMatches++
+	persistent.dayLatency += latency
+	persistent.sessionMatches++
+	persistent.sessionLatency += latency
+}
+
+// endPersistentSession decides whether the player churns, and if not returns them to the pool for their cell
+func endPersistentSession(player *ActivePlayer, reason int) {
+
+	persistent := player.persistent
+	if persistent == nil {
+		return
+	}
+
+	player.persistent = nil
+
+	churnPercent := ChurnBasePercent
+	if persistent.sessionMatches > 0 {
+		averageLatency := persistent.sessionLatency / float64(persistent.sessionMatches)
+		churnPercent += math.Max(0.0, averageLatency-ChurnLatencyThreshold) * ChurnPercentPerMillisecond
+	}
+	if reason != SessionEnd_Left {
+		churnPercent += ChurnFailedSearchPercent
+	}
+
+	if rand.Float64()*100.0 < churnPercent {
+		persistent.churned = true
+		populationChurned++
+		return
+	}
+
+	persistentPool[persistent.lookupIndex] = append(persistentPool[persistent.lookupIndex], persistent)
+}
+
+func retentionBucket(persistent *PersistentPlayer) int {
+	if persistent.dayMatches == 0 {
+		return len(RetentionLatencyBuckets)
+	}
+	averageLatency := persistent.dayLatency / float64(persistent.dayMatches)
+	for i := range RetentionLatencyBuckets {
+		if averageLatency < RetentionLatencyBuckets[i] {
+			return i
+		}
+	}
+	return len(RetentionLatencyBuckets) - 1
+}
+
+// updateRetention runs at the end of each simulated day. it puts everybody active today into today's cohort, and reports
+// the share of yesterday's cohort that came back today
+func updateRetention(day int) {
+
+	numBuckets := len(RetentionBucketNames)
+
+	active := make([]int, numBuckets)
+	returned := make([]int, numBuckets)
+
+	numActiveToday := 0
+
+	for _, persistent := range persistentPlayers {
+		if persistent.cohortDay == day-1 {
+			active[persistent.cohortBucket]++
+			if persistent.lastDay == day {
+				returned[persistent.cohortBucket]++
+			}
+		}
+		if persistent.lastDay == day {
+			persistent.cohortDay = day
+			persistent.cohortBucket = retentionBucket(persistent)
+			numActiveToday++
+		}
+	}
+
+	fmt.Printf("day %d: %d active players, %d in player base, %d new, %d returning, %d churned\n", day, numActiveToday, len(persistentPlayers), populationNewPlayers, populationReturningPlayers, populationChurned)
+
+	populationNewPlayers = 0
+	populationReturningPlayers = 0
+	populationChurned = 0
+
+	if day == 0 {
+		return
+	}
+
+	totalActive := 0
+	totalReturned := 0
+	for i := 0; i < numBuckets; i++ {
+		totalActive += active[i]
+		totalReturned += returned[i]
+		retention := 0.0
+		if active[i] > 0 {
+			retention = float64(returned[i]) / float64(active[i]) * 100.0
+		}
+		fmt.Fprintf(retentionFile, "%d,%s,%d,%d,%.1f\n", day-1, RetentionBucketNames[i], active[i], returned[i], retention)
+	}
+
+	if totalActive > 0 {
+		fmt.Printf("day %d retention: %.1f%% of %d players came back the next day\n", day-1, float64(totalReturned)/float64(totalActive)*100.0, totalActive)
+	}
+}
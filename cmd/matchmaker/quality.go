@@ -0,0 +1,179 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+	Match quality.
+
+	Every match gets a quality score from 0 (worst) to 100 (best), so matchmaking changes can be judged on one number.
+	Each term measures how bad one aspect of the match is, relative to a reference value where it counts as fully bad:
+
+		latency		average latency, against QualityReferenceLatency
+		worst		highest latency in the match, against QualityReferenceLatency
+		spread		difference between highest and lowest latency, against QualityReferenceSpread
+		wait		average search time, against QualityReferenceWait
+
+	The score is 100 * (1 - weighted average of the terms), with each term capped at 1. Weights are set with -quality,
+	and scoring is off when no weights are given. Players have no skill rating in this simulation, so there is no skill
+	spread term yet.
+
+	The score is written to matches.csv, and every hour quality.csv reports its distribution per mode.
+*/
+
+const QualityReferenceLatency = 250.0 // milliseconds
+const QualityReferenceSpread = 100.0
+const QualityReferenceWait = 30.0 // seconds
+
+const QualityTerm_Latency = 0
+const QualityTerm_Worst = 1
+const QualityTerm_Spread = 2
+const QualityTerm_Wait = 3
+const NumQualityTerms = 4
+
+var QualityTermNames = []string{"latency", "worst", "spread", "wait"}
+
+var qualityWeights [NumQualityTerms]float64
+
+var qualityHistograms [][101]int // matches per mode by whole quality score
+
+var qualityFile *os.File
+
+func qualityEnabled() bool {
+	return *qualityWeightsValue != ""
+}
+
+// initializeQuality reads weights as comma separated name=weight pairs, eg. latency=1,worst=0.5,wait=2. terms not listed have no weight
+func initializeQuality(value string) {
+
+	if value == "" {
+		return
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		values := strings.Split(pair, "=")
+		if len(values) != 2 {
+			panic(fmt.Sprintf("quality weights must be name=weight: %s", pair))
+		}
+		weight, err := strconv.ParseFloat(values[1], 64)
+		if err != nil || weight < 0.0 {
+			panic(fmt.Sprintf("invalid quality weight: %s", pair))
+		}
+		found := false
+		for i := range QualityTermNames {
+			if QualityTermNames[i] == values[0] {
+				qualityWeights[i] = weight
+				found = true
+			}
+		}
+		if !found {
+			panic(fmt.Sprintf("unknown quality term: %s", values[0]))
+		}
+	}
+
+	qualityHistograms = make([][101]int, len(gameModes))
+
+	var err error
+	qualityFile, err = os.Create("quality.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprintf(qualityFile, "time,mode,matches,quality,p10,p25,p50,p75,p90\n")
+}
+
+// matchQuality scores a match from 0 to 100, higher is better
+func matchQuality(averageLatency float64, minLatency float64, maxLatency float64, averageSearchTime float64) float64 {
+
+	var terms [NumQualityTerms]float64
+	terms[QualityTerm_Latency] = averageLatency / QualityReferenceLatency
+	terms[QualityTerm_Worst] = maxLatency / QualityReferenceLatency
+	terms[QualityTerm_Spread] = (maxLatency - minLatency) / QualityReferenceSpread
+	terms[QualityTerm_Wait] = averageSearchTime / QualityReferenceWait
+
+	badness := 0.0
+	totalWeight := 0.0
+	for i := range terms {
+		badness += qualityWeights[i] * math.Min(1.0, terms[i])
+		totalWeight += qualityWeights[i]
+	}
+
+	if totalWeight == 0.0 {
+		return 100.0
+	}
+
+	return 100.0 * (1.0 - badness/totalWeight)
+}
+
+func recordMatchQuality(mode int, quality float64) {
+	qualityHistograms[mode][int(math.Floor(quality))]++
+}
+
+func writeQualityStats(timeString string) {
+
+	if qualityFile == nil {
+		return
+	}
+
+	for mode := range qualityHistograms {
+
+		histogram := &qualityHistograms[mode]
+
+		matches := 0
+		total := 0.0
+		for score, count := range histogram {
+			matches += count
+			total += float64(score * count)
+		}
+
+		if matches == 0 {
+			continue
+		}
+
+		// percentile returns the score at or below which this fraction of matches fall
+
+		percentile := func(fraction float64) int {
+			target := int(math.Ceil(fraction * float64(matches)))
+			sum := 0
+			for score, count := range histogram {
+				sum += count
+				if sum >= target && sum > 0 {
+					return score
+				}
+			}
+			return 100
+		}
+
+		fmt.Fprintf(qualityFile, "%s,%s,%d,%.1f,%d,%d,%d,%d,%d\n", timeString, gameModes[mode].name, matches, total/float64(matches), percentile(0.1), percentile(0.25), percentile(0.5), percentile(0.75), percentile(0.9))
+
+		*histogram = [101]int{}
+	}
+}
@@ -0,0 +1,174 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+/*
+	Queue ordering.
+
+	Every tick, right before backfill and matching, each datacenter queue is put in order. The greedy matcher and
+	backfill take players in queue order, and the optimized matcher uses queue order to break ties between players of
+	equal cost. The original policy shuffles the queue, so a player who has waited 19 seconds has no edge over a new
+	arrival. The other policies are:
+
+		fifo		longest waiting first
+		aging		highest priority first, where priority is seconds searched times the weight of the player's search
+					state, so a player's priority grows the longer they wait and grows faster once they expand
+		priority	warm bodies first, then expand, then ideal, shuffled within each class
+
+	When -queue is set, every hour searchtime.csv reports the distribution of search time for matched players, including p99 and max.
+*/
+
+const QueueOrder_Shuffle = 0
+const QueueOrder_FIFO = 1
+const QueueOrder_Aging = 2
+const QueueOrder_Priority = 3
+
+// aging priority gained per second searched, by search state
+const AgingWeight_Ideal = 1.0
+const AgingWeight_Expand = 2.0
+const AgingWeight_WarmBody = 3.0
+
+var QueueOrderNames = []string{"shuffle", "fifo", "aging", "priority"}
+
+var queueOrder int
+
+var searchTimeHistogram []int // matched players by whole seconds searched
+
+var searchTimeFile *os.File
+
+func initializeQueueOrder(name string) {
+
+	if name == "" {
+		queueOrder = QueueOrder_Shuffle
+		return
+	}
+
+	queueOrder = -1
+	for i := range QueueOrderNames {
+		if QueueOrderNames[i] == name {
+			queueOrder = i
+		}
+	}
+	if queueOrder < 0 {
+		panic(fmt.Sprintf("unknown queue order: %s", name))
+	}
+
+	var err error
+	searchTimeFile, err = os.Create("searchtime.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprintf(searchTimeFile, "time,order,matched,searchTime,p50,p90,p99,max\n")
+}
+
+func priorityClass(player *ActivePlayer) int {
+	switch player.state {
+	case PlayerState_WarmBody:
+		return 0
+	case PlayerState_Expand:
+		return 1
+	}
+	return 2
+}
+
+// agingPriority is the player's seconds searched, weighted by how far their search has widened
+func agingPriority(player *ActivePlayer) float64 {
+	switch player.state {
+	case PlayerState_WarmBody:
+		return player.matchingTime * AgingWeight_WarmBody
+	case PlayerState_Expand:
+		return player.matchingTime * AgingWeight_Expand
+	}
+	return player.matchingTime * AgingWeight_Ideal
+}
+
+// orderQueue puts a datacenter queue in order for this tick's matching. players the policy ranks equally stay shuffled
+func orderQueue(queue []*ActivePlayer) {
+
+	rand.Shuffle(len(queue), func(i, j int) {
+		queue[i], queue[j] = queue[j], queue[i]
+	})
+
+	switch queueOrder {
+	case QueueOrder_FIFO:
+		sort.SliceStable(queue, func(i, j int) bool { return queue[i].matchingTime > queue[j].matchingTime })
+	case QueueOrder_Aging:
+		sort.SliceStable(queue, func(i, j int) bool { return agingPriority(queue[i]) > agingPriority(queue[j]) })
+	case QueueOrder_Priority:
+		sort.SliceStable(queue, func(i, j int) bool { return priorityClass(queue[i]) < priorityClass(queue[j]) })
+	}
+}
+
+func recordSearchTime(searchTime float64) {
+	seconds := int(searchTime)
+	for len(searchTimeHistogram) <= seconds {
+		searchTimeHistogram = append(searchTimeHistogram, 0)
+	}
+	searchTimeHistogram[seconds]++
+}
+
+func writeSearchTimeStats(timeString string) {
+
+	if searchTimeFile == nil {
+		return
+	}
+
+	matched := 0
+	total := 0.0
+	max := 0
+	for seconds, count := range searchTimeHistogram {
+		matched += count
+		total += float64(seconds * count)
+		if count > 0 {
+			max = seconds
+		}
+	}
+
+	// percentile returns the smallest search time that at least this fraction of matched players were at or under
+
+	percentile := func(fraction float64) int {
+		target := int(fraction * float64(matched))
+		sum := 0
+		for seconds, count := range searchTimeHistogram {
+			sum += count
+			if sum > 0 && sum >= target {
+				return seconds
+			}
+		}
+		return max
+	}
+
+	average := 0.0
+	if matched > 0 {
+		average = total / float64(matched)
+	}
+
+	fmt.Fprintf(searchTimeFile, "%s,%s,%d,%.2f,%d,%d,%d,%d\n", timeString, QueueOrderNames[queueOrder], matched, average, percentile(0.5), percentile(0.9), percentile(0.99), max)
+
+	searchTimeHistogram = searchTimeHistogram[:0]
+}
@@ -0,0 +1,70 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import "testing"
+
+func checkQueueOrder(t *testing.T, order int, queue []*ActivePlayer, expected ...uint64) {
+	t.Helper()
+	queueOrder = order
+	defer func() { queueOrder = QueueOrder_Shuffle }()
+	orderQueue(queue)
+	for i := range expected {
+		if queue[i].playerId != expected[i] {
+			ids := make([]uint64, len(queue))
+			for j := range queue {
+				ids[j] = queue[j].playerId
+			}
+			t.Fatalf("%s ordered the queue %v, expected %v", QueueOrderNames[order], ids, expected)
+		}
+	}
+}
+
+func TestOrderQueueFIFO(t *testing.T) {
+	queue := []*ActivePlayer{
+		{playerId: 1, state: PlayerState_Ideal, matchingTime: 3},
+		{playerId: 2, state: PlayerState_Expand, matchingTime: 12},
+		{playerId: 3, state: PlayerState_Ideal, matchingTime: 1},
+		{playerId: 4, state: PlayerState_WarmBody, matchingTime: 20},
+	}
+	checkQueueOrder(t, QueueOrder_FIFO, queue, 4, 2, 1, 3)
+}
+
+func TestOrderQueueAging(t *testing.T) {
+
+	// priorities are 10, 12 and 15, so later stages overtake players who have waited longer
+
+	queue := []*ActivePlayer{
+		{playerId: 1, state: PlayerState_Ideal, matchingTime: 10},
+		{playerId: 2, state: PlayerState_Expand, matchingTime: 6},
+		{playerId: 3, state: PlayerState_WarmBody, matchingTime: 5},
+		{playerId: 4, state: PlayerState_Ideal, matchingTime: 2},
+	}
+	checkQueueOrder(t, QueueOrder_Aging, queue, 3, 2, 1, 4)
+}
+
+func TestOrderQueuePriority(t *testing.T) {
+	queue := []*ActivePlayer{
+		{playerId: 1, state: PlayerState_Ideal, matchingTime: 10},
+		{playerId: 2, state: PlayerState_WarmBody, matchingTime: 25},
+		{playerId: 3, state: PlayerState_Expand, matchingTime: 15},
+	}
+	checkQueueOrder(t, QueueOrder_Priority, queue, 2, 3, 1)
+}
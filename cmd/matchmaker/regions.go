@@ -0,0 +1,222 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+	Datacenter allow and deny lists.
+
+	Region locks pin every player inside a latitude/longitude box to a set of datacenter regions, eg. for legal
+	requirements. On top of that, players may pick a region in settings, which limits them to datacenters in the
+	region of their best datacenter, and may deny individual datacenters. The player's datacenter costs are filtered
+	once when they arrive, so queueing, expansion and warm body fill only ever see allowed datacenters.
+*/
+
+const RegionSettingPercent = 5  // chance a player picks their home region in settings
+const DenyDatacenterPercent = 2 // chance a player denies one of their nearest datacenters
+const DenyDatacenterCandidates = 3
+
+// datacenter ids in data/datacenters.csv are grouped into regions by the hundreds digit
+var DatacenterRegionNames = map[uint64]string{
+	1: "northamerica",
+	2: "southamerica",
+	3: "europe",
+	4: "oceania",
+	5: "asia",
+	6: "middleeast",
+	7: "africa",
+}
+
+type RegionLock struct {
+	name         string
+	minLatitude  float64
+	maxLatitude  float64
+	minLongitude float64
+	maxLongitude float64
+	regions      []string // datacenter regions players inside the box are allowed to play in
+	players      int
+}
+
+// DatacenterRules are a player's own datacenter settings
+type DatacenterRules struct {
+	region            string // empty if the player allows every region
+	deniedDatacenters []uint64
+}
+
+var regionLocks []*RegionLock
+
+var datacenterRulesEnabled bool
+
+var numNoAllowedDatacenter int
+
+func datacenterRegion(datacenterId uint64) string {
+	name, ok := DatacenterRegionNames[datacenterId/100]
+	if !ok {
+		return fmt.Sprintf("region%d", datacenterId/100)
+	}
+	return name
+}
+
+// loadRegionLocks reads a csv of name,minLatitude,maxLatitude,minLongitude,maxLongitude followed by one or more allowed regions
+func loadRegionLocks(filename string) []*RegionLock {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	locks := make([]*RegionLock, 0)
+
+	for scanner.Scan() {
+		values := strings.Split(scanner.Text(), ",")
+		if len(values) < 6 {
+			continue
+		}
+		minLatitude, err1 := strconv.ParseFloat(values[1], 64)
+		maxLatitude, err2 := strconv.ParseFloat(values[2], 64)
+		minLongitude, err3 := strconv.ParseFloat(values[3], 64)
+		maxLongitude, err4 := strconv.ParseFloat(values[4], 64)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			continue
+		}
+		lock := &RegionLock{name: values[0], minLatitude: minLatitude, maxLatitude: maxLatitude, minLongitude: minLongitude, maxLongitude: maxLongitude}
+		for _, region := range values[5:] {
+			lock.regions = append(lock.regions, strings.TrimSpace(region))
+		}
+		locks = append(locks, lock)
+	}
+
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("loaded %d region locks from %s\n", len(locks), filename)
+
+	return locks
+}
+
+func initializeDatacenterRules() {
+	if *regionLocksFilename != "" {
+		regionLocks = loadRegionLocks(*regionLocksFilename)
+	}
+	datacenterRulesEnabled = len(regionLocks) > 0 || *regionSettings
+}
+
+// randomDatacenterRules simulates the datacenter settings players pick for themselves
+func randomDatacenterRules(datacenterCosts []DatacenterCostEntry) DatacenterRules {
+	rules := DatacenterRules{}
+	if !*regionSettings || len(datacenterCosts) == 0 {
+		return rules
+	}
+	if percentChance(RegionSettingPercent) {
+		rules.region = datacenterRegion(datacenterCosts[0].datacenterId)
+	}
+	if percentChance(DenyDatacenterPercent) {
+		candidates := DenyDatacenterCandidates
+		if candidates > len(datacenterCosts) {
+			candidates = len(datacenterCosts)
+		}
+		rules.deniedDatacenters = []uint64{datacenterCosts[rand.Intn(candidates)].datacenterId}
+	}
+	return rules
+}
+
+func regionLock(latitude float64, longitude float64) *RegionLock {
+	for _, lock := range regionLocks {
+		if latitude >= lock.minLatitude && latitude <= lock.maxLatitude && longitude >= lock.minLongitude && longitude <= lock.maxLongitude {
+			return lock
+		}
+	}
+	return nil
+}
+
+func datacenterAllowed(player *ActivePlayer, lock *RegionLock, datacenterId uint64) bool {
+	region := datacenterRegion(datacenterId)
+	if lock != nil {
+		allowed := false
+		for i := range lock.regions {
+			if lock.regions[i] == region {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if player.datacenterRules.region != "" && player.datacenterRules.region != region {
+		return false
+	}
+	for _, denied := range player.datacenterRules.deniedDatacenters {
+		if denied == datacenterId {
+			return false
+		}
+	}
+	return true
+}
+
+// applyDatacenterRules filters the player's datacenter costs down to the datacenters their region lock and settings allow.
+// the filtered list keeps the cost order. players left without any allowed datacenter can never be matched
+func applyDatacenterRules(player *ActivePlayer) {
+
+	lock := regionLock(player.latitude, player.longitude)
+	if lock != nil {
+		lock.players++
+	}
+
+	if lock == nil && player.datacenterRules.region == "" && len(player.datacenterRules.deniedDatacenters) == 0 {
+		return
+	}
+
+	allowed := make([]DatacenterCostEntry, 0, len(player.datacenterCosts))
+	for _, entry := range player.datacenterCosts {
+		if datacenterAllowed(player, lock, entry.datacenterId) {
+			allowed = append(allowed, entry)
+		}
+	}
+
+	if len(allowed) == 0 {
+		numNoAllowedDatacenter++
+	}
+
+	player.datacenterCosts = allowed
+}
+
+func printDatacenterRuleStats() {
+	if !datacenterRulesEnabled {
+		return
+	}
+	for _, lock := range regionLocks {
+		fmt.Printf("region lock %s: %d players\n", lock.name, lock.players)
+	}
+	fmt.Printf("%d players had no allowed datacenter\n", numNoAllowedDatacenter)
+}
@@ -0,0 +1,116 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// SessionModel decides how long players stay in the game once they arrive
+type SessionModel interface {
+
+	// SessionLength is called once when a player arrives and returns how many seconds they intend to play for
+	SessionLength(player *ActivePlayer, seconds uint64) float64
+
+	// ThinkTime is called when a match finishes and returns the seconds before the player decides whether to play again
+	ThinkTime(player *ActivePlayer) uint64
+
+	// PlayAgain is called after think time. players that don't play again leave the game
+	PlayAgain(player *ActivePlayer, seconds uint64) bool
+}
+
+// FlatSessionModel is the original model: a flat chance to play again after a fixed time between matches
+type FlatSessionModel struct{}
+
+func (model *FlatSessionModel) SessionLength(player *ActivePlayer, seconds uint64) float64 {
+	return math.Inf(1)
+}
+
+func (model *FlatSessionModel) ThinkTime(player *ActivePlayer) uint64 {
+	return BetweenMatchSeconds
+}
+
+func (model *FlatSessionModel) PlayAgain(player *ActivePlayer, seconds uint64) bool {
+	return percentChance(PlayAgainPercent)
+}
+
+// RealisticSessionModel draws session length from a log-normal distribution whose median depends on the player's local
+// time of day, lowers the chance to play again as the player racks up matches, and draws think time from a log-normal
+type RealisticSessionModel struct{}
+
+// median session length in minutes by local hour. late evening sessions run longest
+var SessionMedianMinutes = [24]float64{75, 60, 45, 40, 30, 30, 25, 25, 25, 30, 30, 35, 35, 35, 40, 40, 45, 50, 60, 70, 80, 90, 90, 85}
+
+const SessionSigma = 0.8
+
+// percent chance to play again by matches already played. the last entry applies to every match after that
+var PlayAgainPercentByMatches = []int{90, 85, 80, 75, 70, 65, 60, 55, 50}
+
+const ThinkTimeMedianSeconds = 25.0
+const ThinkTimeSigma = 0.5
+const MinThinkTimeSeconds = 5
+const MaxThinkTimeSeconds = 180
+
+func localHour(longitude float64, seconds uint64) int {
+	utcHours := float64(seconds%SecondsPerDay) / 3600.0
+	hour := int(math.Floor(utcHours + longitude/15.0))
+	return ((hour % 24) + 24) % 24
+}
+
+func logNormal(median float64, sigma float64) float64 {
+	return median * math.Exp(rand.NormFloat64()*sigma)
+}
+
+func (model *RealisticSessionModel) SessionLength(player *ActivePlayer, seconds uint64) float64 {
+	median := SessionMedianMinutes[localHour(player.longitude, seconds)] * 60.0
+	return logNormal(median, SessionSigma)
+}
+
+func (model *RealisticSessionModel) ThinkTime(player *ActivePlayer) uint64 {
+	thinkTime := logNormal(ThinkTimeMedianSeconds, ThinkTimeSigma)
+	thinkTime = math.Max(MinThinkTimeSeconds, math.Min(MaxThinkTimeSeconds, thinkTime))
+	return uint64(math.Round(thinkTime))
+}
+
+func (model *RealisticSessionModel) PlayAgain(player *ActivePlayer, seconds uint64) bool {
+	if float64(seconds-player.sessionStart) >= player.sessionLength {
+		return false
+	}
+	index := player.matchesPlayed
+	if index >= len(PlayAgainPercentByMatches) {
+		index = len(PlayAgainPercentByMatches) - 1
+	}
+	return percentChance(PlayAgainPercentByMatches[index])
+}
+
+var sessionModel SessionModel
+
+func createSessionModel(name string) SessionModel {
+	switch name {
+	case "flat":
+		return &FlatSessionModel{}
+	case "realistic":
+		return &RealisticSessionModel{}
+	default:
+		panic(fmt.Sprintf("unknown session model: %s", name))
+	}
+}
@@ -0,0 +1,313 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+	Search schedule.
+
+	A search is a list of stages. Each stage has a cost threshold and a duration, and the player searches the queues of
+	every datacenter under the threshold until the duration runs out, then moves on to the next stage. New players start
+	in the first stage whose threshold their best datacenter is under. Stages can also have rules:
+
+		any		warm body stage. the player is fed into datacenter queues by warm body fill instead of by threshold
+		bots	when the stage runs out, complete a match with bots for the player instead of moving on
+
+	The last stage runs one second longer than its duration, then the search times out and the player fails, or gets
+	bot filled with -bots. Each player remembers the queues they have joined during the search. Entering a stage adds
+	them to the queues under its threshold they aren't in yet, and never takes them out of a queue, so a stage with a
+	lower threshold than the one before it keeps the wider set of queues. Warm body stages take the player out of every
+	queue, and the next threshold stage after one joins its queues again.
+
+	The default schedule is ideal, expand and warm body. Its thresholds and times come from the game mode and adaptive
+	thresholds. Pass -stages with a csv of name,threshold,duration[,rule...] to try other schedules. Threshold is a cost
+	in milliseconds, or ideal or expand for the default thresholds, and duration is seconds, or ideal or expand for the
+	default times. For example:
+
+		close,30,5
+		ideal,ideal,ideal
+		expand,expand,expand
+		wide,200,10
+		warmbody,0,10,any,bots
+
+	Stages are reported to the search state counts as ideal for the first stage, warm body for any datacenter stages,
+	and expand for everything else.
+*/
+
+const StageValue_Fixed = 0
+const StageValue_Ideal = 1 // the game mode's ideal threshold or time, adjusted by adaptive thresholds
+const StageValue_Expand = 2
+
+type SearchStage struct {
+	name          string
+	threshold     int // StageValue_*
+	costThreshold float64
+	time          int // StageValue_*
+	duration      int
+	anyDatacenter bool
+	allowBots     bool
+	entered       int
+	matched       int // matched with other players only
+	botFilled     int
+	timedOut      int // failed when the stage ran out
+}
+
+var DefaultSearchStages = []SearchStage{
+	{name: "ideal", threshold: StageValue_Ideal, time: StageValue_Ideal},
+	{name: "expand", threshold: StageValue_Expand, time: StageValue_Expand},
+	{name: "warmbody", duration: WarmBodyTime, anyDatacenter: true},
+}
+
+var searchStages []SearchStage
+
+func initializeSearchStages(filename string) {
+	if filename == "" {
+		searchStages = make([]SearchStage, len(DefaultSearchStages))
+		copy(searchStages, DefaultSearchStages)
+		return
+	}
+	searchStages = loadSearchStages(filename)
+	fmt.Printf("loaded %d search stages from %s\n", len(searchStages), filename)
+}
+
+func parseStageValue(value string) (int, float64, error) {
+	switch value {
+	case "ideal":
+		return StageValue_Ideal, 0.0, nil
+	case "expand":
+		return StageValue_Expand, 0.0, nil
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	return StageValue_Fixed, number, err
+}
+
+// loadSearchStages reads rows of name,threshold,duration[,rule...]
+func loadSearchStages(filename string) []SearchStage {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
+
+	defer f.Close()
+
+	stages := make([]SearchStage, 0, 8)
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		values := strings.Split(scanner.Text(), ",")
+		if len(values) < 3 {
+			continue
+		}
+		stage := SearchStage{name: values[0]}
+		for _, rule := range values[3:] {
+			switch strings.TrimSpace(rule) {
+			case "any":
+				stage.anyDatacenter = true
+			case "bots":
+				stage.allowBots = true
+			default:
+				panic(fmt.Sprintf("unknown rule for search stage %s: %s", stage.name, rule))
+			}
+		}
+		var threshold, duration float64
+		var err1, err2 error
+		stage.threshold, threshold, err1 = parseStageValue(values[1])
+		stage.time, duration, err2 = parseStageValue(values[2])
+		if (err1 != nil && !stage.anyDatacenter) || err2 != nil || duration < 0.0 {
+			panic(fmt.Sprintf("invalid search stage: %s", scanner.Text()))
+		}
+		stage.costThreshold = threshold
+		stage.duration = int(duration)
+		stages = append(stages, stage)
+	}
+
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	if len(stages) == 0 {
+		panic(fmt.Sprintf("no search stages in %s", filename))
+	}
+
+	return stages
+}
+
+func stageCostThreshold(player *ActivePlayer, mode int, index int) float64 {
+	stage := &searchStages[index]
+	if stage.anyDatacenter {
+		return math.Inf(1)
+	}
+	switch stage.threshold {
+	case StageValue_Ideal:
+		return idealCostThreshold(player, mode)
+	case StageValue_Expand:
+		return expandCostThreshold(player, mode)
+	}
+	return stage.costThreshold
+}
+
+func stageDuration(player *ActivePlayer, index int) int {
+	stage := &searchStages[index]
+	switch stage.time {
+	case StageValue_Ideal:
+		return idealTime(player)
+	case StageValue_Expand:
+		return expandTime(player)
+	}
+	return stage.duration
+}
+
+// stagePlayerState maps a stage onto the search state the rest of the matchmaker sees
+func stagePlayerState(index int) int {
+	if searchStages[index].anyDatacenter {
+		return PlayerState_WarmBody
+	} else if index == 0 {
+		return PlayerState_Ideal
+	}
+	return PlayerState_Expand
+}
+
+// QueueKey identifies one game mode queue on one datacenter
+type QueueKey struct {
+	datacenterId uint64
+	mode         int
+}
+
+// enterStage moves the player into a stage and adds them to the queues of datacenters under the stage's threshold
+// that they haven't already joined. thresholds are read now, so they may have changed since earlier stages were entered
+func enterStage(player *ActivePlayer, index int) {
+
+	player.stage = index
+	player.state = stagePlayerState(index)
+	player.counter = 0
+
+	searchStages[index].entered++
+
+	if searchStages[index].anyDatacenter {
+		// warm bodies are taken out of every queue at the end of the tick, and fed back in by warm body fill
+		player.queued = make(map[QueueKey]bool)
+		return
+	}
+
+	for _, mode := range player.modes {
+		threshold := stageCostThreshold(player, mode, index)
+		for j := range player.datacenterCosts {
+			datacenterId := player.datacenterCosts[j].datacenterId
+			if player.datacenterCosts[j].cost > threshold {
+				break
+			}
+			key := QueueKey{datacenterId: datacenterId, mode: mode}
+			if !player.queued[key] {
+				datacenters[datacenterId].playerQueues[mode] = append(datacenters[datacenterId].playerQueues[mode], player)
+				player.queued[key] = true
+			}
+		}
+	}
+}
+
+// startSearch puts a new player in the first stage their best datacenter is under the threshold of. players that no
+// datacenter is allowed for go to the first warm body stage, or the last stage, where they fail to find a match
+func startSearch(player *ActivePlayer) {
+	cost := math.Inf(1)
+	if len(player.datacenterCosts) > 0 {
+		cost = player.datacenterCosts[0].cost
+	}
+	last := len(searchStages) - 1
+	for index := range searchStages {
+		if index == last || searchStages[index].anyDatacenter || cost <= stageCostThreshold(player, player.modes[0], index) {
+			player.queued = make(map[QueueKey]bool)
+			enterStage(player, index)
+			return
+		}
+	}
+}
+
+func lastStage(player *ActivePlayer) bool {
+	return player.stage == len(searchStages)-1
+}
+
+// stageEnded is true when the player has used up their time in the current stage
+func stageEnded(player *ActivePlayer) bool {
+	if lastStage(player) {
+		return player.counter > stageDuration(player, player.stage)
+	}
+	return player.counter >= stageDuration(player, player.stage)
+}
+
+// failSearch ends the search of a player who ran out of stages without a match. the failed state keeps them out of
+// matching while they are still in datacenter queues, until the end of the tick takes them out
+func failSearch(player *ActivePlayer) {
+	searchStages[player.stage].timedOut++
+	gameModes[player.modes[0]].failures++
+	recordCalibration(player, false)
+	if searchStages[player.stage].anyDatacenter {
+		numWarmBodyFailures++
+	}
+	if player.spike != 0 {
+		spikeStats(player).failures++
+		player.spike = 0
+	}
+	player.state = PlayerState_Failed
+	endPersistentSession(player, SessionEnd_Failed)
+}
+
+// botFillAtStageEnd is true if the player should be bot filled now that their stage has ended
+func botFillAtStageEnd(player *ActivePlayer) bool {
+	if len(player.datacenterCosts) == 0 {
+		return false
+	}
+	return searchStages[player.stage].allowBots || (*botFill && lastStage(player))
+}
+
+// maxStageDuration is the longest the stage can last. adaptive thresholds can stretch ideal and expand times up to
+// MaxSearchStageTime, and a replayed schedule can use any time they chose
+func maxStageDuration(index int) int {
+	duration := stageDuration(&ActivePlayer{}, index)
+	if searchStages[index].time != StageValue_Fixed && (adaptiveMode == Adaptive_All || adaptiveMode == Adaptive_Schedule) && duration < MaxSearchStageTime {
+		duration = MaxSearchStageTime
+	}
+	return duration
+}
+
+// searchScheduleSeconds is the longest a search can take, with every stage at its longest and the bot wait on top
+func searchScheduleSeconds() int {
+	total := 1 // the last stage runs one second over
+	for index := range searchStages {
+		total += maxStageDuration(index)
+	}
+	return total + int(math.Ceil(*botWaitSeconds))
+}
+
+func printSearchStageStats() {
+	for index := range searchStages {
+		stage := &searchStages[index]
+		fmt.Printf("search stage %s: %d entered, %d matched, %d bot filled, %d failed\n", stage.name, stage.entered, stage.matched, stage.botFilled, stage.timedOut)
+	}
+}
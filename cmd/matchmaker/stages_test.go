@@ -0,0 +1,218 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnterStageLowerThreshold(t *testing.T) {
+
+	setupTestDatacenters(5)
+
+	searchStages = []SearchStage{
+		{name: "a", costThreshold: 50, duration: 5},
+		{name: "b", costThreshold: 30, duration: 5},
+		{name: "c", costThreshold: 100, duration: 10},
+	}
+
+	player := testPlayer(1, 20, 40, 60, 90, 120)
+
+	startSearch(player)
+	if player.stage != 0 || player.state != PlayerState_Ideal {
+		t.Fatalf("expected the player to start in stage 0 as ideal, got stage %d state %d", player.stage, player.state)
+	}
+	checkQueueEntries(t, player, 1, 2)
+
+	enterStage(player, 1)
+	if player.state != PlayerState_Expand {
+		t.Fatalf("expected the player to be expand in stage 1, got state %d", player.state)
+	}
+	checkQueueEntries(t, player, 1, 2)
+
+	enterStage(player, 2)
+	checkQueueEntries(t, player, 1, 2, 3, 4)
+}
+
+func TestEnterStageAdaptiveThresholds(t *testing.T) {
+
+	setupTestDatacenters(5)
+
+	searchStages = make([]SearchStage, len(DefaultSearchStages))
+	copy(searchStages, DefaultSearchStages)
+
+	region := &RegionThresholds{idealCostThreshold: IdealCostThreshold, expandCostThreshold: ExpandCostThreshold, idealTime: IdealTime, expandTime: ExpandTime}
+
+	// thresholds tighten below the ideal threshold the player started with before they expand
+
+	tightened := testPlayer(1, 20, 40, 60, 90, 120)
+	tightened.thresholds = region
+
+	startSearch(tightened)
+	checkQueueEntries(t, tightened, 1, 2)
+
+	region.idealCostThreshold = 30
+	region.expandCostThreshold = 45
+
+	enterStage(tightened, 1)
+	checkQueueEntries(t, tightened, 1, 2)
+
+	// thresholds loosen, so expanding adds every queue under the new expand threshold
+
+	region.idealCostThreshold = IdealCostThreshold
+	region.expandCostThreshold = ExpandCostThreshold
+
+	loosened := testPlayer(2, 20, 40, 60, 90, 120)
+	loosened.thresholds = region
+
+	startSearch(loosened)
+	checkQueueEntries(t, loosened, 1, 2)
+
+	enterStage(loosened, 1)
+	checkQueueEntries(t, loosened, 1, 2, 3, 4)
+}
+
+func TestEnterStageAfterWarmBody(t *testing.T) {
+
+	setupTestDatacenters(4)
+
+	searchStages = []SearchStage{
+		{name: "close", costThreshold: 30, duration: 5},
+		{name: "warmbody", duration: 5, anyDatacenter: true},
+		{name: "wide", costThreshold: 100, duration: 5},
+	}
+
+	player := testPlayer(1, 20, 40, 60, 90)
+
+	startSearch(player)
+	checkQueueEntries(t, player, 1)
+
+	enterStage(player, 1)
+	if player.state != PlayerState_WarmBody {
+		t.Fatalf("expected the player to be a warm body in stage 1, got state %d", player.state)
+	}
+	checkQueueEntries(t, player, 1)
+
+	// the end of the tick takes warm bodies out of every queue
+
+	for _, datacenter := range datacenters {
+		datacenter.playerQueues[0] = datacenter.playerQueues[0][:0]
+	}
+
+	enterStage(player, 2)
+	checkQueueEntries(t, player, 1, 2, 3, 4)
+}
+
+func TestLoadSearchStages(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "stages.csv")
+
+	data := "close,30,5\nideal,ideal,ideal\nskipped\nexpand,expand,expand\nwarmbody,0,10,any,bots\n"
+	if err := os.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stages := loadSearchStages(filename)
+
+	expected := []SearchStage{
+		{name: "close", threshold: StageValue_Fixed, costThreshold: 30, time: StageValue_Fixed, duration: 5},
+		{name: "ideal", threshold: StageValue_Ideal, time: StageValue_Ideal},
+		{name: "expand", threshold: StageValue_Expand, time: StageValue_Expand},
+		{name: "warmbody", threshold: StageValue_Fixed, time: StageValue_Fixed, duration: 10, anyDatacenter: true, allowBots: true},
+	}
+
+	if len(stages) != len(expected) {
+		t.Fatalf("loaded %d stages, expected %d", len(stages), len(expected))
+	}
+	for i := range expected {
+		if stages[i] != expected[i] {
+			t.Errorf("stage %d is %+v, expected %+v", i, stages[i], expected[i])
+		}
+	}
+}
+
+func TestLoadSearchStagesInvalid(t *testing.T) {
+
+	rows := []string{
+		"close,30,5,unknown\n",
+		"close,near,5\n",
+		"close,30,-1\n",
+		"\n",
+	}
+
+	for _, row := range rows {
+		filename := filepath.Join(t.TempDir(), "stages.csv")
+		if err := os.WriteFile(filename, []byte(row), 0644); err != nil {
+			t.Fatal(err)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected %q to be rejected", row)
+				}
+			}()
+			loadSearchStages(filename)
+		}()
+	}
+}
+
+func TestFailedPlayerNotMatched(t *testing.T) {
+
+	setupTestDatacenters(1)
+
+	searchStages = []SearchStage{{name: "close", costThreshold: 60, duration: 2}}
+
+	players := make([]*ActivePlayer, gameModes[0].playersPerMatch+1)
+	for i := range players {
+		players[i] = testPlayer(uint64(i+1), 20)
+		players[i].predictedWait = -1.0
+		startSearch(players[i])
+	}
+
+	failSearch(players[0])
+	if players[0].state != PlayerState_Failed {
+		t.Fatalf("expected the failed player to be in the failed state, got state %d", players[0].state)
+	}
+	checkQueueEntries(t, players[0], 1)
+
+	for _, matcher := range []Matcher{&GreedyMatcher{}, &OptimizedMatcher{objective: Objective_Total}} {
+		matches := matcher.FindMatches(false)
+		if len(matches) != 1 {
+			t.Fatalf("found %d matches, expected 1", len(matches))
+		}
+		for _, player := range matches[0].players {
+			if player == players[0] {
+				t.Fatalf("the failed player was matched")
+			}
+		}
+	}
+
+	// with only the failed player and one short of a match left, there is no match
+
+	datacenters[1].playerQueues[0] = players[:gameModes[0].playersPerMatch]
+
+	for _, matcher := range []Matcher{&GreedyMatcher{}, &OptimizedMatcher{objective: Objective_Total}} {
+		if matches := matcher.FindMatches(false); len(matches) != 0 {
+			t.Fatalf("found %d matches with the failed player in the queue, expected none", len(matches))
+		}
+	}
+}
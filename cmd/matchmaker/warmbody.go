@@ -0,0 +1,208 @@
+/*
+	Matchmaker Simulation
+
+	Copyright (c) 2023 - 2024, Mas Bandwidth LLC. All rights reserved.
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+/*
+	Warm body fill.
+
+	Players who reach the warm body stage are fed back into datacenter queues every second so they can fill matches that
+	are short of players. By default they go into every datacenter they have a latency for. The policy can limit this to
+	datacenters under a latency ceiling, to the N nearest datacenters with players searching in the mode, and to only
+	the datacenters where a match is one player short: either a queue one player short of a full match, or a running
+	match with one open slot waiting for backfill. When no datacenter is one short, warm bodies are placed as usual.
+
+	When any of these policies are set, every hour warmbody.csv reports queue entries per warm body, and the latency of warm bodies and of the matches they
+	end up in compared with matches without them.
+*/
+
+var warmBodyFile *os.File
+
+var numWarmBodySeconds int // warm body players fed into queues, summed over ticks
+var numWarmBodyPlacements int
+var numWarmBodiesMatched int
+var numWarmBodyFailures int
+var warmBodyLatency float64
+var maxWarmBodyLatency float64
+var numWarmBodyMatches int // matches started with at least one warm body
+var numOtherMatches int
+var warmBodyMatchLatency float64
+var otherMatchLatency float64
+
+func warmBodyPolicyEnabled() bool {
+	return *warmBodyCeiling > 0.0 || *warmBodyNearest > 0 || *warmBodyShort
+}
+
+func initializeWarmBodies() {
+
+	if !warmBodyPolicyEnabled() {
+		return
+	}
+
+	var err error
+	warmBodyFile, err = os.Create("warmbody.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Fprintf(warmBodyFile, "time,placementsPerWarmBody,matched,failures,latency,maxLatency,matches,warmBodyMatches,warmBodyMatchLatency,otherMatchLatency\n")
+}
+
+// warmBodyTargets returns the datacenters to place the warm body in for this mode, in order. with -warmshort these are
+// only the datacenters one player short, if there are any
+func warmBodyTargets(player *ActivePlayer, mode int, demand map[uint64][]int, oneShort map[uint64][]int) []uint64 {
+
+	playersPerMatch := gameModes[mode].playersPerMatch
+
+	targets := make([]uint64, 0, len(player.datacenterCosts))
+	short := make([]uint64, 0, 4)
+
+	for _, entry := range player.datacenterCosts {
+
+		if *warmBodyCeiling > 0.0 && entry.latency > *warmBodyCeiling {
+			continue
+		}
+
+		if *warmBodyNearest > 0 && demand[entry.datacenterId][mode] == 0 && oneShort[entry.datacenterId][mode] == 0 {
+			continue
+		}
+
+		if *warmBodyShort && (oneShort[entry.datacenterId][mode] > 0 || demand[entry.datacenterId][mode]%playersPerMatch == playersPerMatch-1) {
+			short = append(short, entry.datacenterId)
+		} else {
+			targets = append(targets, entry.datacenterId)
+		}
+	}
+
+	if len(short) > 0 {
+		targets = short
+	}
+
+	if *warmBodyNearest > 0 && len(targets) > *warmBodyNearest {
+		targets = targets[:*warmBodyNearest]
+	}
+
+	return targets
+}
+
+// feedWarmBodies places warm bodies into datacenter queues for next tick's matching. longest waiting players are placed first
+func feedWarmBodies(warmBodies map[uint64]*ActivePlayer) {
+
+	players := make([]*ActivePlayer, 0, len(warmBodies))
+	for _, player := range warmBodies {
+		players = append(players, player)
+	}
+	sort.Slice(players, func(i, j int) bool {
+		if players[i].matchingTime != players[j].matchingTime {
+			return players[i].matchingTime > players[j].matchingTime
+		}
+		return players[i].playerId < players[j].playerId
+	})
+
+	// players searching per datacenter and mode, and running matches that are one player short
+
+	demand := make(map[uint64][]int, len(datacenters))
+	oneShort := make(map[uint64][]int, len(datacenters))
+	for datacenterId, datacenter := range datacenters {
+		counts := make([]int, len(gameModes))
+		for mode, queue := range datacenter.playerQueues {
+			counts[mode] = len(queue)
+		}
+		demand[datacenterId] = counts
+		oneShort[datacenterId] = make([]int, len(gameModes))
+	}
+	for _, match := range openMatches {
+		if len(match.openSlots) == 1 {
+			oneShort[match.datacenterId][match.mode]++
+		}
+	}
+
+	for _, player := range players {
+		for _, mode := range player.modes {
+			for _, datacenterId := range warmBodyTargets(player, mode, demand, oneShort) {
+				datacenter := datacenters[datacenterId]
+				datacenter.playerQueues[mode] = append(datacenter.playerQueues[mode], player)
+				if oneShort[datacenterId][mode] > 0 {
+					oneShort[datacenterId][mode]--
+				} else {
+					demand[datacenterId][mode]++
+				}
+				numWarmBodyPlacements++
+			}
+		}
+	}
+
+	numWarmBodySeconds += len(players)
+}
+
+func recordWarmBodyMatched(latency float64) {
+	numWarmBodiesMatched++
+	warmBodyLatency += latency
+	maxWarmBodyLatency = math.Max(maxWarmBodyLatency, latency)
+}
+
+func recordWarmBodyMatch(match *MatchData, averageLatency float64) {
+	if match.warmBodies > 0 {
+		numWarmBodyMatches++
+		warmBodyMatchLatency += averageLatency
+	} else {
+		numOtherMatches++
+		otherMatchLatency += averageLatency
+	}
+}
+
+func writeWarmBodyStats(timeString string) {
+	if warmBodyFile == nil {
+		return
+	}
+	placements := 0.0
+	latency := 0.0
+	matchLatency := 0.0
+	otherLatency := 0.0
+	if numWarmBodySeconds > 0 {
+		placements = float64(numWarmBodyPlacements) / float64(numWarmBodySeconds)
+	}
+	if numWarmBodiesMatched > 0 {
+		latency = warmBodyLatency / float64(numWarmBodiesMatched)
+	}
+	if numWarmBodyMatches > 0 {
+		matchLatency = warmBodyMatchLatency / float64(numWarmBodyMatches)
+	}
+	if numOtherMatches > 0 {
+		otherLatency = otherMatchLatency / float64(numOtherMatches)
+	}
+	fmt.Fprintf(warmBodyFile, "%s,%.1f,%d,%d,%.1f,%.1f,%d,%d,%.1f,%.1f\n", timeString, placements, numWarmBodiesMatched, numWarmBodyFailures, latency, maxWarmBodyLatency, numWarmBodyMatches+numOtherMatches, numWarmBodyMatches, matchLatency, otherLatency)
+	numWarmBodySeconds = 0
+	numWarmBodyPlacements = 0
+	numWarmBodiesMatched = 0
+	numWarmBodyFailures = 0
+	warmBodyLatency = 0.0
+	maxWarmBodyLatency = 0.0
+	numWarmBodyMatches = 0
+	numOtherMatches = 0
+	warmBodyMatchLatency = 0.0
+	otherMatchLatency = 0.0
+}
@@ -27,6 +27,7 @@ import (
 	"strings"
 	"strconv"
 	"encoding/binary"
+	"flag"
 )
 
 const LatencyMapWidth = 360
@@ -35,6 +36,12 @@ const LatencyMapSize = LatencyMapWidth * LatencyMapHeight
 const LatencyMapBytes = LatencyMapSize * 4
 const ConservativeFactor = 2.0
 
+const CellFlag_Estimated = 0 // no samples. the matchmaker estimates latency from distance
+const CellFlag_Measured = 1
+const CellFlag_Filled = 2 // no samples. latency was filled in from neighbouring cells
+
+var timeBuckets = flag.Int("buckets", 0, "also transform this many time of day maps per datacenter, eg. 24 transforms latency_<city>_b00.bin to latency_<city>_b23.bin")
+
 func haversineDistance(lat1 float64, long1 float64, lat2 float64, long2 float64) float64 {
 	lat1 *= math.Pi / 180
 	lat2 *= math.Pi / 180
@@ -128,6 +135,35 @@ func fillInHolesFilter(inputArray []float32, outputArray []float32, x int, y int
 	*/
 }
 
+func readFloatArray(filename string) []float32 {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	if len(data) != LatencyMapBytes {
+		panic(fmt.Sprintf("%s is invalid size (%d bytes)", filename, len(data)))
+	}
+	index := 0
+	floatArray := make([]float32, LatencyMapSize)
+	for i := 0; i < LatencyMapSize; i++ {
+		integerValue := binary.LittleEndian.Uint32(data[index : index+4])
+		floatArray[i] = math.Float32frombits(integerValue)
+		index += 4
+	}
+	return floatArray
+}
+
+func writeFloatArray(filename string, floatArray []float32) {
+	data := make([]byte, len(floatArray)*4)
+	index := 0
+	for i := range floatArray {
+		integerValue := math.Float32bits(floatArray[i])
+		binary.LittleEndian.PutUint32(data[index:index+4], integerValue)
+		index += 4
+	}
+	os.WriteFile(filename, data, 0666)
+}
+
 func transform(inputFilename string, outputFilename string, datacenterLatitude float64, datacenterLongitude float64) {
 
 	data, err := os.ReadFile(inputFilename)
@@ -148,6 +184,28 @@ func transform(inputFilename string, outputFilename string, datacenterLatitude f
 		index += 4
 	}
 
+	// load sample counts and cell flags if average wrote them. older maps without them are treated as fully measured
+
+	inputBasename := strings.TrimSuffix(inputFilename, ".bin")
+
+	samples := readFloatArray(inputBasename + "_samples.bin")
+	hasSamples := samples != nil
+	if !hasSamples {
+		samples = make([]float32, LatencyMapSize)
+	}
+
+	flags, err := os.ReadFile(inputBasename + "_flags.bin")
+	if err != nil {
+		flags = make([]byte, LatencyMapSize)
+		for i := 0; i < LatencyMapSize; i++ {
+			if floatArray[i] > 0.0 {
+				flags[i] = CellFlag_Measured
+			}
+		}
+	} else if len(flags) != LatencyMapSize {
+		panic(fmt.Sprintf("%s_flags.bin is invalid size (%d bytes)", inputBasename, len(flags)))
+	}
+
 	// IMPORTANT: clear "null island" at ~(0,0) lat/long
 	index = LatencyMapWidth/2 + LatencyMapHeight/2 * LatencyMapWidth
 	floatArray[index-LatencyMapWidth] = 0.0
@@ -199,21 +257,34 @@ func transform(inputFilename string, outputFilename string, datacenterLatitude f
 		}
 		latitude -= 1.0
 	}
-	floatArray = outputArray
 
-	data = make([]byte, LatencyMapBytes)
-	index = 0
+	// Cells that survived filtering keep their flag, cells that were cleared lose their samples, and holes that got a value are marked as filled
 	for i := 0; i < LatencyMapSize; i++ {
-		integerValue := math.Float32bits(floatArray[i])
-		binary.LittleEndian.PutUint32(data[index:index+4], integerValue)
-		index += 4
+		if floatArray[i] >= 1.0 {
+			continue
+		}
+		samples[i] = 0.0
+		if outputArray[i] > 0.0 {
+			flags[i] = CellFlag_Filled
+		} else {
+			flags[i] = CellFlag_Estimated
+		}
 	}
+	floatArray = outputArray
+
+	outputBasename := strings.TrimSuffix(outputFilename, ".bin")
 
-	os.WriteFile(outputFilename, data, 0666)
+	writeFloatArray(outputFilename, floatArray)
+	if hasSamples {
+		writeFloatArray(outputBasename+"_samples.bin", samples)
+	}
+	os.WriteFile(outputBasename+"_flags.bin", flags, 0666)
 }
 
 func main() {
 
+	flag.Parse()
+
 	f, err := os.Open("data/datacenters.csv")
 	if err != nil {
 		panic(err)
@@ -248,5 +319,11 @@ func main() {
 		dest_filename := fmt.Sprintf("latency_%s_transformed.bin", city)
 		fmt.Printf("%s\n", dest_filename)
 		transform(source_filename, dest_filename, latitudes[i], longitudes[i])
+		for bucket := 0; bucket < *timeBuckets; bucket++ {
+			source_filename := fmt.Sprintf("./data/latency_%s_b%02d.bin", city, bucket)
+			dest_filename := fmt.Sprintf("latency_%s_transformed_b%02d.bin", city, bucket)
+			fmt.Printf("%s\n", dest_filename)
+			transform(source_filename, dest_filename, latitudes[i], longitudes[i])
+		}
 	}
 }